@@ -1,8 +1,66 @@
 /*
 	This program will display information about reserved instances and when they expire.
+	EC2, RDS, ElastiCache and Redshift reservations can all be checked and shown in
+	one report with the service they belong to.
 	As Amazon will not tell you when a reserved instance has expired and let it continue
 	as on demand it is a good idea to keep an eye on reserved instances
 
+	AWS credentials are found using the standard credential chain, the environment
+	then ${HOME}/.aws/credentials then the instance role, or from a named profile.
+
+	Command line options -
+	-r AWS Region. Read from AWS_REGION or AWS_DEFAULT_REGION if not provided, then from
+	   the region of the profile, or the default profile, in ${HOME}/.aws/config
+	-p Named profile in ${HOME}/.aws/credentials to use
+	-regions Comma separated list of regions to check instead of -r
+	-profiles Comma separated list of named profiles to check instead of -p
+	-roles Comma separated list of role ARNs to assume and check, using the -p credentials
+	-concurrency Number of accounts and regions checked at once. Default 4
+	-services Comma separated list of services to check from ec2, rds, elasticache
+	   and redshift. Default ec2 so only EC2 permissions are needed. OpenSearch
+	   reservations and Savings Plans are not checked as the SDK has no API for them
+	-d Number of days till expire
+	-e Retired in last number of days. Can be used with -d to show both
+	-u Display utilisation of active reservations against running instances and
+	   the number of running instances that are on demand for each instance type.
+	   Regional Linux/UNIX reservations are matched across their family in
+	   normalized units so part of an instance can be covered. The SDK only tells
+	   Windows instances from the rest, so reservations for Red Hat, SUSE or SQL
+	   Server are shown as unused and those instances count as Windows or Linux/UNIX
+	-o Output format text, json or csv. Default text
+	-sort Sort reservations by expiry date, soonest first
+	-g Group reservations by type or az with the total instance count of each group
+	-renew Display the current offerings that could replace each EC2 reservation
+	   expiring within -d days with their upfront, hourly and effective hourly cost
+	-purchase Offering id to purchase. Displays the offering and what it would cost
+	-purchase-count Number of instances to purchase. Default 1
+	-plan Propose modifications that move unused zonal reserved capacity onto running
+	   on demand instances in the same family, by size or AZ, with the exact
+	   ModifyReservedInstances request for each
+	-apply Submit the modifications proposed by -plan
+	-confirm Purchase the offering given by -purchase or submit the -apply modifications
+
+	-listen Run as a Prometheus exporter serving /metrics on this address, e.g. :9101
+	-interval How often the exporter lists the reservations. Default 1h
+	   In exporter mode retired reservations are included if they expired within -e days
+
+	Reservations expiring within -d days can be sent to a webhook as JSON, to a Slack
+	compatible webhook and by email. Each reservation is only announced again after
+	-renotify days. When sending email SMTP_USERNAME and SMTP_PASSWORD are used to
+	authenticate if they are set. -notify-test sends a sample notice to local stub
+	servers to check the notifiers without talking to AWS. Notices are sent after the
+	report is displayed and if any notifier fails the exit status is 1.
+
+	-webhook URL to post expiring reservations to as JSON
+	-slack Slack compatible incoming webhook URL
+	-smtp SMTP server host:port to email expiring reservations through
+	-mail-from Email from address
+	-mail-to Comma separated list of email addresses
+	-state File recording when each reservation was announced.
+	   Default ${HOME}/.aws-check-reserved-instances.json
+	-renotify Days before announcing a reservation again. 0 only announces once. Default 7
+	-notify-test Send a sample notice to local stub servers and exit
+
 */
 
 package main
@@ -10,145 +68,342 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/gombadi/goamz/aws"
-	"github.com/gombadi/goamz/ec2"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
 	"github.com/gombadi/go-ini"
 )
 
+// stringValue returns the string or an empty string if it is nil
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// configRegion returns the region of the profile from the shared config file
+// ${HOME}/.aws/config, or AWS_CONFIG_FILE if it is set. If the profile has no region
+// the default profile region is used
+func configRegion(profile string) string {
+
+	fileName := os.Getenv("AWS_CONFIG_FILE")
+	if len(fileName) == 0 {
+		fileName = os.Getenv("HOME") + "/.aws/config"
+	}
+
+	iniFile, err := ini.LoadFile(fileName)
+	if err != nil {
+		return ""
+	}
+
+	if len(profile) == 0 {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if len(profile) > 0 && profile != "default" {
+		// named profiles are [profile name] in the config file
+		for _, section := range []string{"profile " + profile, profile} {
+			if region, ok := iniFile.Get(section, "region"); ok && len(region) > 0 {
+				return region
+			}
+		}
+	}
+
+	region, _ := iniFile.Get("default", "region")
+	return region
+}
+
+// awsConfig builds the config for the region using the profile if one is given
+// otherwise the standard credential chain
+func awsConfig(regionName, profile string) (*aws.Config, error) {
+
+	if len(regionName) == 0 {
+		regionName = os.Getenv("AWS_REGION")
+	}
+	if len(regionName) == 0 {
+		regionName = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if len(regionName) == 0 {
+		regionName = configRegion(profile)
+	}
+	if len(regionName) == 0 {
+		return nil, fmt.Errorf("unable to find AWS Region information. Use -r, set AWS_REGION or add a region to ${HOME}/.aws/config")
+	}
+
+	config := &aws.Config{Region: regionName}
+
+	if len(profile) > 0 {
+		creds, err := aws.ProfileCreds("", profile, 10*time.Minute)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load profile %s: %v", profile, err)
+		}
+		config.Credentials = creds
+	}
+	return config, nil
+}
+
 func main() {
 
-	// pointers to objects we use to talk to AWS
-	var e *ec2.EC2
 	// storage for commandline args
-	var regionName, awsKey, awsSecret string
+	var regionName, profile string
 	var expireDays, retireDays int
-	var ok bool
+	var utilisation, notifyTestFlag, sortExpiry, renew, confirmPurchase bool
+	var planMods, applyMods bool
+	var purchaseID string
+	var purchaseCount int64
+	var outputFormat, groupBy, serviceList string
+	var regionList, profileList, roleList string
+	var concurrency int
+	var listen string
+	var interval time.Duration
+	var webhookURL, slackURL, smtpAddr, mailFrom, mailTo, stateFile string
+	var renotifyDays int
 
-	flag.StringVar(&regionName, "r", "xxxx", "AWS Region to send request. Read from ${HOME}/.aws/config if not provided")
-	flag.StringVar(&awsKey, "k", "xxxx", "AWS Access Key.Read from ${HOME}/.aws/config if not provided")
-	flag.StringVar(&awsSecret, "s", "xxxx", "AWS Secret key. Read from ${HOME}/.aws/config if not provided")
+	flag.StringVar(&regionName, "r", "", "AWS Region to send request. Read from AWS_REGION or ${HOME}/.aws/config if not provided")
+	flag.StringVar(&profile, "p", "", "Named profile in ${HOME}/.aws/credentials to use")
+	flag.StringVar(&regionList, "regions", "", "Comma separated list of regions to check")
+	flag.StringVar(&profileList, "profiles", "", "Comma separated list of named profiles to check")
+	flag.StringVar(&roleList, "roles", "", "Comma separated list of role ARNs to assume and check")
+	flag.IntVar(&concurrency, "concurrency", 4, "Number of accounts and regions checked at once")
+	flag.StringVar(&serviceList, "services", "ec2", "Comma separated list of services to check from "+strings.Join(allServices, ", "))
 	// flags for reserved instances
 	flag.IntVar(&expireDays, "d", 0, "Number of days till expire")
 	flag.IntVar(&retireDays, "e", 0, "Retired in last number of days")
+	flag.BoolVar(&utilisation, "u", false, "Display reservation utilisation and on demand coverage")
+	flag.StringVar(&outputFormat, "o", "text", "Output format text, json or csv")
+	flag.BoolVar(&sortExpiry, "sort", false, "Sort reservations by expiry date")
+	flag.StringVar(&groupBy, "g", "", "Group reservations by type or az")
+	// flags for renewing reservations
+	flag.BoolVar(&renew, "renew", false, "Display renewal offerings for expiring EC2 reservations")
+	flag.StringVar(&purchaseID, "purchase", "", "Offering id to purchase")
+	flag.Int64Var(&purchaseCount, "purchase-count", 1, "Number of instances to purchase")
+	// flags for modifying reservations
+	flag.BoolVar(&planMods, "plan", false, "Propose modifications for unused reservations")
+	flag.BoolVar(&applyMods, "apply", false, "Submit the modifications proposed by -plan")
+	flag.BoolVar(&confirmPurchase, "confirm", false, "Purchase the offering given by -purchase or submit the -apply modifications")
+	// flags for exporter mode
+	flag.StringVar(&listen, "listen", "", "Run as a Prometheus exporter serving /metrics on this address")
+	flag.DurationVar(&interval, "interval", time.Hour, "How often the exporter lists the reservations")
+	// flags for expiry notifications
+	flag.StringVar(&webhookURL, "webhook", "", "URL to post expiring reservations to as JSON")
+	flag.StringVar(&slackURL, "slack", "", "Slack compatible incoming webhook URL")
+	flag.StringVar(&smtpAddr, "smtp", "", "SMTP server host:port to email expiring reservations through")
+	flag.StringVar(&mailFrom, "mail-from", "", "Email from address")
+	flag.StringVar(&mailTo, "mail-to", "", "Comma separated list of email addresses")
+	flag.StringVar(&stateFile, "state", os.Getenv("HOME")+"/.aws-check-reserved-instances.json", "File recording when each reservation was announced")
+	flag.IntVar(&renotifyDays, "renotify", 7, "Days before announcing a reservation again. 0 only announces once")
+	flag.BoolVar(&notifyTestFlag, "notify-test", false, "Send a sample notice to local stub servers and exit")
 	flag.Parse()
 
-	// read the standard AWS ini file in case it is needed
-	iniFile, err := ini.LoadFile(os.Getenv("HOME") + "/.aws/config")
+	if notifyTestFlag {
+		if err := notifyTest(); err != nil {
+			fmt.Printf("Error - notification test failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	switch {
+	case flag.NArg() > 0:
+		// flags after the first argument are not parsed so they would be silently ignored
+		fmt.Printf("Error - unexpected argument %s. Every option must be given as a flag\n", flag.Arg(0))
+		os.Exit(1)
+	case outputFormat != "text" && outputFormat != "json" && outputFormat != "csv":
+		fmt.Printf("Error - unknown output format %s. Use text, json or csv\n", outputFormat)
+		os.Exit(1)
+	case groupBy != "" && groupBy != "type" && groupBy != "az":
+		fmt.Printf("Error - unknown grouping %s. Use type or az\n", groupBy)
+		os.Exit(1)
+	case applyMods && !planMods:
+		fmt.Printf("Error - -apply needs -plan\n")
+		os.Exit(1)
+	case (utilisation || renew || planMods) && outputFormat == "csv":
+		fmt.Printf("Error - -u, -renew and -plan are only available with text or json output\n")
+		os.Exit(1)
+	case (utilisation || renew || planMods) && !strings.Contains(","+serviceList+",", ",ec2,"):
+		fmt.Printf("Error - -u, -renew and -plan need ec2 in the list of services\n")
+		os.Exit(1)
+	case renew && expireDays <= 0:
+		fmt.Printf("Error - -renew needs -d to select the expiring reservations\n")
+		os.Exit(1)
+	case purchaseCount < 1:
+		fmt.Printf("Error - -purchase-count must be at least 1\n")
+		os.Exit(1)
+	case concurrency < 1:
+		fmt.Printf("Error - -concurrency must be at least 1\n")
+		os.Exit(1)
+	case len(listen) > 0 && interval < time.Minute:
+		fmt.Printf("Error - -interval must be at least 1m\n")
+		os.Exit(1)
+	}
+
+	targets := sweepTargets(regionName, profile, regionList, profileList, roleList)
+	if (utilisation || renew || planMods || len(purchaseID) > 0) && len(targets) > 1 {
+		fmt.Printf("Error - -u, -renew, -plan and -purchase work on a single account and region\n")
+		os.Exit(1)
+	}
 
-	// use any values not supplied on the command line
-	if regionName == "xxxx" {
-		regionName, ok = iniFile.Get("default", "region")
-		if !ok {
-			fmt.Printf("Error - unable to find AWS Region information\n")
+	services := strings.Split(serviceList, ",")
+	for _, service := range services {
+		if _, found := reservationSources[service]; !found && service != "ec2" {
+			fmt.Printf("Error - unknown service %s. Use %s\n", service, strings.Join(allServices, ", "))
 			os.Exit(1)
 		}
 	}
 
-	//  read secret key from command line or ini file
-	// if either secret key or access key are not provided then read all info from ini file
-	if awsSecret == "xxxx" || awsKey == "xxxx" {
-		awsSecret, ok = iniFile.Get("default", "aws_secret_access_key")
-		if !ok {
-			fmt.Printf("Error - unable to find AWS Secret Key information\n")
+	notifiers := []notifier{}
+	if len(webhookURL) > 0 {
+		notifiers = append(notifiers, webhookNotifier{url: webhookURL})
+	}
+	if len(slackURL) > 0 {
+		notifiers = append(notifiers, slackNotifier{url: slackURL})
+	}
+	if len(smtpAddr) > 0 {
+		if len(mailFrom) == 0 || len(mailTo) == 0 {
+			fmt.Printf("Error - -mail-from and -mail-to are required to send email\n")
 			os.Exit(1)
 		}
+		notifiers = append(notifiers, smtpNotifier{addr: smtpAddr, from: mailFrom, to: strings.Split(mailTo, ",")})
+	}
 
-		awsKey, ok = iniFile.Get("default", "aws_access_key_id")
-		if !ok {
-			fmt.Printf("Error - unable to find AWS Access Key information\n")
+	// a purchase is made on its own without the report
+	if len(purchaseID) > 0 {
+		config, err := targetConfig(targets[0])
+		if err != nil {
+			fmt.Printf("Error - %v\n", err)
 			os.Exit(1)
 		}
+		if err := purchaseOffering(ec2.New(config), purchaseID, purchaseCount, confirmPurchase); err != nil {
+			log.Fatalf("Error - purchasing %s: %v\n", purchaseID, err)
+		}
+		os.Exit(0)
 	}
-	// store auth info in environment
-	os.Setenv("AWS_SECRET_ACCESS_KEY", awsSecret)
-	os.Setenv("AWS_ACCESS_KEY_ID", awsKey)
 
-	// Pull the access details from environment variables
-	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
-	auth, err := aws.EnvAuth()
-	if err != nil {
-		fmt.Printf("Error unable to find Access and/or Secret key\n")
-		os.Exit(1)
+	if len(listen) > 0 {
+		err := runExporter(listen, interval, retireDays, func() []*sweepResult {
+			return sweepAll(targets, services, concurrency)
+		})
+		log.Fatalf("Error - %v\n", err)
 	}
 
-	// create the objects we will use to talk to AWS
-	switch regionName {
-	case "eu-west-1":
-		e = ec2.New(auth, aws.EUWest)
-	case "sa-east-1":
-		e = ec2.New(auth, aws.SAEast)
-	case "us-east-1":
-		e = ec2.New(auth, aws.USEast)
-	case "ap-northeast-1":
-		e = ec2.New(auth, aws.APNortheast)
-	case "us-west-2":
-		e = ec2.New(auth, aws.USWest2)
-	case "us-west-1":
-		e = ec2.New(auth, aws.USWest)
-	case "ap-southeast-1":
-		e = ec2.New(auth, aws.APSoutheast)
-	case "ap-southeast-2":
-		e = ec2.New(auth, aws.APSoutheast2)
-	default:
-		fmt.Printf("Error - Sorry I can not find the url endpoint for region %s\n", regionName)
-		os.Exit(1)
+	// collect the reservations of every service in every account and region. A
+	// failure is reported and everything else is still checked
+	results := sweepAll(targets, services, concurrency)
+
+	reservations := []reservationRow{}
+	for _, result := range results {
+		reservations = append(reservations, result.rows...)
 	}
+	failed := printSweepErrors(os.Stderr, results)
 
-	instanceResp, err := e.DescribeReservedInstances(nil, nil)
-	if err != nil {
-		fmt.Println("\nBother, things are not looking good getting the Reserved Instance details...\n")
-		panic(err)
+	// no headings in structured output
+	if outputFormat == "text" && (expireDays > 0 || retireDays > 0) {
+		if expireDays > 0 {
+			fmt.Printf("Displaying reserved instances that will expire within the next %d days\n", expireDays)
+		}
+		if retireDays > 0 {
+			fmt.Printf("Displaying reserved instances that have expired within the last %d days\n", retireDays)
+		}
+		fmt.Printf("\n")
 	}
 
-	switch {
-	case expireDays > 0:
-		fmt.Printf("Displaying reserved instances that will expire within the next %d days\n\n", expireDays)
-		// if expireDays provided then ignore retireDays
-		retireDays = 0
-	case retireDays > 0:
-		fmt.Printf("Displaying reserved instances that have expired within the last %d days\n\n", retireDays)
+	rows := selectRows(reservations, expireDays, retireDays, time.Now())
+
+	notices := []expiryNotice{}
+	for _, row := range rows {
+		if row.DaysRemaining != nil {
+			notices = append(notices, newExpiryNotice(row))
+		} else if len(row.DateError) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning - %s reservation %s: %s\n", row.Service, row.ReservationID, row.DateError)
+		}
 	}
 
-	// extract the private ip address from the instance struct stored in the reservation
-	for reservedInstance := range instanceResp.ReservedInstances {
+	if sortExpiry {
+		sortByExpiry(rows)
+	}
 
-		// extract the time this reserved instance expires
-		t, _ := time.Parse(time.RFC3339, instanceResp.ReservedInstances[reservedInstance].End)
+	report := &reservationReport{}
+	if len(groupBy) > 0 {
+		report.Groups = groupRows(rows, groupBy)
+	} else {
+		report.Reservations = rows
+	}
 
-		elapsed := time.Since(t)
+	// -u, -renew and -plan only have a single target
+	single := results[0]
+	if (utilisation || renew || planMods) && single.config == nil {
+		os.Exit(1)
+	}
 
-		if expireDays > 0 {
-			if (int(elapsed.Hours()/24) > (0 - expireDays)) && instanceResp.ReservedInstances[reservedInstance].State == "active" {
-				// Display info on instances that will expire soon
-				fmt.Printf("Reserved_instance: %s\tOffer_Type: %s\tState: %s\nNum_of_instances: %d\tInstance_Type: %s\tAV-Zone: %s\tExpire: %s\n\n",
-					instanceResp.ReservedInstances[reservedInstance].ReservedInstanceId,
-					instanceResp.ReservedInstances[reservedInstance].OfferingType,
-					instanceResp.ReservedInstances[reservedInstance].State,
-					instanceResp.ReservedInstances[reservedInstance].InstanceCount,
-					instanceResp.ReservedInstances[reservedInstance].InstanceType,
-					instanceResp.ReservedInstances[reservedInstance].AvailabilityZone,
-					instanceResp.ReservedInstances[reservedInstance].End)
-			}
+	if utilisation || planMods {
+		instances, err := runningInstances(ec2.New(single.config))
+		if err != nil {
+			log.Fatalf("Fatal error: DescribeInstances - %s\n", err)
 		}
+		if utilisation {
+			report.Utilisation = computeUtilisation(single.ec2Reserved, instances)
+		}
+		if planMods {
+			report.Modifications = planModifications(single.ec2Reserved, instances)
+		}
+	}
 
-		if retireDays > 0 {
-			if (retireDays > int(elapsed.Hours()/24)) && instanceResp.ReservedInstances[reservedInstance].State == "retired" {
-				// Display info on instances that will expire soon
-				fmt.Printf("Reserved_instance: %s\tOffer_Type: %s\tState: %s\nNum_of_instances: %d\tInstance_Type: %s\tAV-Zone: %s\tExpire: %s\n\n",
-					instanceResp.ReservedInstances[reservedInstance].ReservedInstanceId,
-					instanceResp.ReservedInstances[reservedInstance].OfferingType,
-					instanceResp.ReservedInstances[reservedInstance].State,
-					instanceResp.ReservedInstances[reservedInstance].InstanceCount,
-					instanceResp.ReservedInstances[reservedInstance].InstanceType,
-					instanceResp.ReservedInstances[reservedInstance].AvailabilityZone,
-					instanceResp.ReservedInstances[reservedInstance].End)
-			}
+	if renew {
+		renewals, err := renewalOptions(ec2.New(single.config), single.ec2Reserved, rows)
+		if err != nil {
+			log.Fatalf("Error - %v\n", err)
 		}
+		report.Renewals = renewals
+	}
 
+	var err error
+	switch outputFormat {
+	case "json":
+		err = report.writeJSON(os.Stdout)
+	case "csv":
+		err = report.writeCSV(os.Stdout)
+	default:
+		report.printText(os.Stdout, groupBy)
+	}
+	if err != nil {
+		log.Fatalf("Error - writing report: %v\n", err)
+	}
+
+	// notices are sent once the report is out so a notifier failure does not hide it
+	if len(notifiers) > 0 && len(notices) > 0 {
+		if err := sendNotices(notifiers, notices, stateFile, renotifyDays); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - %v\n", err)
+			failed = true
+		}
+	}
+
+	if applyMods && len(report.Modifications) > 0 {
+		if err := applyModifications(ec2.New(single.config), report.Modifications, confirmPurchase); err != nil {
+			log.Fatalf("Error - %v\n", err)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
 
+// newExpiryNotice builds the notice for a reservation that is about to expire
+func newExpiryNotice(row reservationRow) expiryNotice {
 
+	return expiryNotice{
+		Account:          row.Account,
+		Service:          row.Service,
+		ReservationID:    row.ReservationID,
+		InstanceType:     row.InstanceType,
+		InstanceCount:    row.InstanceCount,
+		AvailabilityZone: row.AvailabilityZone,
+		Region:           row.Region,
+		End:              row.End,
+		DaysLeft:         *row.DaysRemaining,
 	}
 }
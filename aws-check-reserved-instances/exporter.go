@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricLabel escapes a label value for the Prometheus text format
+var metricLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// renderMetrics writes the reservations in the Prometheus text format. Retired
+// reservations are only included if they expired within the last retireDays so old
+// reservations do not stay in the metrics forever
+func renderMetrics(results []*sweepResult, retireDays int, now time.Time) []byte {
+
+	var days, count, state, success bytes.Buffer
+
+	for _, r := range results {
+		ok := 1
+		if len(r.errors) > 0 {
+			ok = 0
+		}
+		fmt.Fprintf(&success, "aws_reserved_instances_sweep_success{account=\"%s\",region=\"%s\"} %d\n",
+			metricLabel.Replace(r.target.account), metricLabel.Replace(r.target.region), ok)
+
+		for _, row := range r.rows {
+			if len(row.DateError) > 0 {
+				continue
+			}
+			remaining := row.End.Sub(now).Hours() / 24
+			if row.State == "retired" && -remaining > float64(retireDays) {
+				continue
+			}
+
+			labels := fmt.Sprintf("account=\"%s\",region=\"%s\",service=\"%s\",reservation_id=\"%s\",instance_type=\"%s\",availability_zone=\"%s\"",
+				metricLabel.Replace(row.Account), metricLabel.Replace(row.Region), metricLabel.Replace(row.Service),
+				metricLabel.Replace(row.ReservationID), metricLabel.Replace(row.InstanceType), metricLabel.Replace(row.AvailabilityZone))
+
+			fmt.Fprintf(&days, "aws_reserved_instance_days_until_expiry{%s} %.3f\n", labels, remaining)
+			fmt.Fprintf(&count, "aws_reserved_instance_count{%s} %d\n", labels, row.InstanceCount)
+			fmt.Fprintf(&state, "aws_reserved_instance_state{%s,state=\"%s\"} 1\n", labels, metricLabel.Replace(row.State))
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "# HELP aws_reserved_instance_days_until_expiry Days until the reservation expires, negative once it has expired.\n")
+	fmt.Fprintf(&out, "# TYPE aws_reserved_instance_days_until_expiry gauge\n")
+	out.Write(days.Bytes())
+	fmt.Fprintf(&out, "# HELP aws_reserved_instance_count Number of instances or nodes in the reservation.\n")
+	fmt.Fprintf(&out, "# TYPE aws_reserved_instance_count gauge\n")
+	out.Write(count.Bytes())
+	fmt.Fprintf(&out, "# HELP aws_reserved_instance_state Always 1, the state label is the state of the reservation.\n")
+	fmt.Fprintf(&out, "# TYPE aws_reserved_instance_state gauge\n")
+	out.Write(state.Bytes())
+	fmt.Fprintf(&out, "# HELP aws_reserved_instances_sweep_success 1 if every service was listed for the account and region.\n")
+	fmt.Fprintf(&out, "# TYPE aws_reserved_instances_sweep_success gauge\n")
+	out.Write(success.Bytes())
+	fmt.Fprintf(&out, "# HELP aws_reserved_instances_last_refresh_timestamp_seconds When the reservations were last listed.\n")
+	fmt.Fprintf(&out, "# TYPE aws_reserved_instances_last_refresh_timestamp_seconds gauge\n")
+	fmt.Fprintf(&out, "aws_reserved_instances_last_refresh_timestamp_seconds %d\n", now.Unix())
+
+	return out.Bytes()
+}
+
+// runExporter serves /metrics on listen, listing the reservations with sweep every interval.
+// The metrics are served from the last refresh so a scrape never waits on AWS
+func runExporter(listen string, interval time.Duration, retireDays int, sweep func() []*sweepResult) error {
+
+	var mu sync.Mutex
+	var metrics []byte
+
+	refresh := func() {
+		results := sweep()
+		printSweepErrors(os.Stderr, results)
+		body := renderMetrics(results, retireDays, time.Now())
+
+		mu.Lock()
+		metrics = body
+		mu.Unlock()
+	}
+
+	refresh()
+	go func() {
+		for range time.Tick(interval) {
+			refresh()
+		}
+	}()
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		body := metrics
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(body)
+	})
+
+	log.Printf("Serving reserved instance metrics on %s/metrics every %s\n", listen, interval)
+	return http.ListenAndServe(listen, nil)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// expiryNotice is a reservation that is about to expire
+type expiryNotice struct {
+	Account          string    `json:"account"`
+	Service          string    `json:"service"`
+	ReservationID    string    `json:"reservation_id"`
+	InstanceType     string    `json:"instance_type"`
+	InstanceCount    int64     `json:"instance_count"`
+	AvailabilityZone string    `json:"availability_zone,omitempty"`
+	Region           string    `json:"region"`
+	End              time.Time `json:"end"`
+	DaysLeft         int       `json:"days_left"`
+}
+
+// stateKey identifies the reservation in the state file
+func (n expiryNotice) stateKey() string {
+	return reservationKey(n.Account, n.Region, n.Service, n.ReservationID)
+}
+
+// notifier sends expiry notices to somewhere people will see them
+type notifier interface {
+	Name() string
+	Notify(notices []expiryNotice) error
+}
+
+// noticeText is the human readable message for the notices
+func noticeText(notices []expiryNotice) string {
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d reservation(s) will expire soon:\n", len(notices))
+	for _, n := range notices {
+		fmt.Fprintf(&buf, "%s %s %s\t%d x %s\t%s %s\texpires %s (%d days)\n",
+			n.Account, n.Service, n.ReservationID, n.InstanceCount, n.InstanceType, n.Region, n.AvailabilityZone,
+			n.End.Format("2006-01-02"), n.DaysLeft)
+	}
+	return buf.String()
+}
+
+// postJSON sends the value as a JSON POST request and checks for a 2xx response
+func postJSON(url string, v interface{}) error {
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier posts the notices as JSON to a URL
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) Name() string { return "webhook" }
+
+func (w webhookNotifier) Notify(notices []expiryNotice) error {
+	return postJSON(w.url, map[string]interface{}{"expiring": notices})
+}
+
+// slackNotifier posts the notices to a Slack compatible incoming webhook
+type slackNotifier struct {
+	url string
+}
+
+func (s slackNotifier) Name() string { return "slack" }
+
+func (s slackNotifier) Notify(notices []expiryNotice) error {
+	return postJSON(s.url, map[string]string{"text": "```" + noticeText(notices) + "```"})
+}
+
+// smtpNotifier emails the notices. SMTP_USERNAME and SMTP_PASSWORD are used to
+// authenticate if they are set
+type smtpNotifier struct {
+	addr string
+	from string
+	to   []string
+}
+
+func (m smtpNotifier) Name() string { return "email" }
+
+func (m smtpNotifier) Notify(notices []expiryNotice) error {
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); len(user) > 0 {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %d reservation(s) expiring soon\r\n\r\n%s",
+		m.from, strings.Join(m.to, ", "), len(notices), strings.Replace(noticeText(notices), "\n", "\r\n", -1))
+
+	return smtp.SendMail(m.addr, auth, m.from, m.to, []byte(msg))
+}
+
+// notifyState records when each reservation was last announced, keyed by stateKey
+type notifyState map[string]time.Time
+
+// loadNotifyState reads the state file. A missing file is an empty state
+func loadNotifyState(fileName string) (notifyState, error) {
+
+	state := notifyState{}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return state, nil
+}
+
+// save writes the state file
+func (s notifyState) save(fileName string) error {
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, 0600)
+}
+
+// due returns the notices that have not been announced within the last renotifyDays.
+// With renotifyDays of 0 a reservation is only ever announced once
+func (s notifyState) due(notices []expiryNotice, renotifyDays int) []expiryNotice {
+
+	due := []expiryNotice{}
+	for _, n := range notices {
+		last, found := s[n.stateKey()]
+		if found && (renotifyDays == 0 || time.Since(last) < time.Duration(renotifyDays)*24*time.Hour) {
+			continue
+		}
+		due = append(due, n)
+	}
+	return due
+}
+
+// sendNotices sends the notices that are due to every notifier and records them in the
+// state file if they were all sent
+func sendNotices(notifiers []notifier, notices []expiryNotice, stateFile string, renotifyDays int) error {
+
+	state, err := loadNotifyState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	due := state.due(notices, renotifyDays)
+	if len(due) == 0 {
+		return nil
+	}
+
+	failed := []string{}
+	for _, n := range notifiers {
+		if err := n.Notify(due); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", n.Name(), err))
+		}
+	}
+
+	// if any notifier failed try them all again on the next run
+	if len(failed) > 0 {
+		return fmt.Errorf("sending notifications failed - %s", strings.Join(failed, "; "))
+	}
+
+	now := time.Now()
+	for _, n := range due {
+		state[n.stateKey()] = now
+	}
+	return state.save(stateFile)
+}
+
+// notifyTest sends a sample notice to a local HTTP stub and a local SMTP stub using
+// every notifier and displays what the stubs received
+func notifyTest() error {
+
+	received := make(chan string, 10)
+
+	httpStub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- fmt.Sprintf("HTTP %s %s\n%s\n", r.Method, r.URL.Path, body)
+	}))
+	defer httpStub.Close()
+
+	smtpStub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer smtpStub.Close()
+	go serveSMTPStub(smtpStub, received)
+
+	notices := []expiryNotice{{
+		Account:          "default",
+		Service:          "ec2",
+		ReservationID:    "test-reservation",
+		InstanceType:     "m3.medium",
+		InstanceCount:    2,
+		AvailabilityZone: "us-east-1a",
+		Region:           "us-east-1",
+		End:              time.Now().Add(72 * time.Hour),
+		DaysLeft:         3,
+	}}
+
+	notifiers := []notifier{
+		webhookNotifier{url: httpStub.URL + "/webhook"},
+		slackNotifier{url: httpStub.URL + "/slack"},
+		smtpNotifier{addr: smtpStub.Addr().String(), from: "reserved@example.com", to: []string{"ops@example.com"}},
+	}
+
+	for _, n := range notifiers {
+		if err := n.Notify(notices); err != nil {
+			return fmt.Errorf("%s: %v", n.Name(), err)
+		}
+		fmt.Printf("--- %s stub received:\n%s\n", n.Name(), <-received)
+	}
+	return nil
+}
+
+// serveSMTPStub accepts SMTP connections and sends each message it receives to the channel
+func serveSMTPStub(l net.Listener, received chan<- string) {
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			fmt.Fprintf(conn, "220 localhost stub\r\n")
+
+			var msg bytes.Buffer
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				cmd := strings.ToUpper(strings.TrimSpace(line))
+
+				switch {
+				case strings.HasPrefix(cmd, "DATA"):
+					fmt.Fprintf(conn, "354 go ahead\r\n")
+					for {
+						data, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if strings.TrimRight(data, "\r\n") == "." {
+							break
+						}
+						msg.WriteString(data)
+					}
+					received <- "SMTP\n" + msg.String()
+					fmt.Fprintf(conn, "250 ok\r\n")
+				case strings.HasPrefix(cmd, "QUIT"):
+					fmt.Fprintf(conn, "221 bye\r\n")
+					return
+				default:
+					fmt.Fprintf(conn, "250 ok\r\n")
+				}
+			}
+		}(conn)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+)
+
+// familySizes are the sizes used to express normalized units, largest first
+var familySizes = []string{"xlarge", "large", "medium", "small", "micro", "nano"}
+
+// targetConfiguration is one of the configurations a reservation is modified into
+type targetConfiguration struct {
+	AvailabilityZone string `json:"AvailabilityZone"`
+	InstanceCount    int64  `json:"InstanceCount"`
+	InstanceType     string `json:"InstanceType"`
+}
+
+// modificationRequest is the ModifyReservedInstances request for a modification
+type modificationRequest struct {
+	ClientToken          string                `json:"ClientToken"`
+	ReservedInstancesIDs []string              `json:"ReservedInstancesIds"`
+	TargetConfigurations []targetConfiguration `json:"TargetConfigurations"`
+}
+
+// modification is a proposed change to a reservation with unused capacity
+type modification struct {
+	ReservationID    string              `json:"reservation_id"`
+	InstanceType     string              `json:"instance_type"`
+	AvailabilityZone string              `json:"availability_zone,omitempty"`
+	InstanceCount    int64               `json:"instance_count"`
+	Unused           int64               `json:"unused"`
+	Reason           string              `json:"reason"`
+	Request          modificationRequest `json:"request"`
+}
+
+// onDemand is a group of running on demand instances a reservation could cover
+type onDemand struct {
+	key   usageKey
+	az    string
+	count int64
+}
+
+// planModifications proposes modifications that move the unused part of each active
+// zonal reservation onto running on demand instances. Linux/UNIX reservations with
+// default tenancy can change size within the family as long as the total normalized
+// units stay the same. Any zonal reservation can be split across AZs. The SDK has no
+// scope or offering class so regional reservations are left as they are and every
+// target configuration is zonal
+func planModifications(ris []*ec2.ReservedInstances, instances []*ec2.Instance) []*modification {
+
+	match := matchReservations(ris, instances)
+
+	// on demand instances in a stable order so the plan is the same every run
+	available := []*onDemand{}
+	for key, azs := range match.uncovered {
+		for az, count := range azs {
+			// an instance partly covered by a size flexible reservation stays as it is
+			if n := int64(math.Floor(count)); n > 0 {
+				available = append(available, &onDemand{key: key, az: az, count: n})
+			}
+		}
+	}
+	sort.Slice(available, func(i, j int) bool {
+		if available[i].key.instanceType != available[j].key.instanceType {
+			return available[i].key.instanceType < available[j].key.instanceType
+		}
+		return available[i].az < available[j].az
+	})
+
+	mods := []*modification{}
+	for _, ri := range ris {
+		if stringValue(ri.State) != "active" || ri.InstanceCount == nil {
+			continue
+		}
+		id := stringValue(ri.ReservedInstancesID)
+		// a regional reservation already covers every AZ, and AWS applies the size
+		// flexible ones across the family
+		riAZ := stringValue(ri.AvailabilityZone)
+		if len(riAZ) == 0 {
+			continue
+		}
+		// zonal reservations only cover whole instances of their own type
+		used := int64(match.used[id])
+		unused := *ri.InstanceCount - used
+		if unused <= 0 {
+			continue
+		}
+
+		key := riKey(ri)
+		family, factor, flexible := normalizationFactor(key.instanceType)
+		flexible = flexible && key.platform == "Linux/UNIX" && key.tenancy == "default"
+
+		// take on demand instances until the unused units are used up
+		units := float64(unused)
+		if flexible {
+			units *= factor
+		}
+		taken := map[targetConfiguration]int64{}
+
+		for _, od := range available {
+			if od.count == 0 || od.key.platform != key.platform || od.key.tenancy != key.tenancy {
+				continue
+			}
+			// a zonal reservation already covers its own AZ
+			if od.key.instanceType == key.instanceType && od.az == riAZ {
+				continue
+			}
+
+			odFactor := 1.0
+			if od.key.instanceType != key.instanceType {
+				odFamily, f, ok := normalizationFactor(od.key.instanceType)
+				if !flexible || !ok || odFamily != family {
+					continue
+				}
+				odFactor = f
+			} else if flexible {
+				odFactor = factor
+			}
+
+			n := int64(math.Floor(units / odFactor))
+			if n > od.count {
+				n = od.count
+			}
+			if n == 0 {
+				continue
+			}
+			od.count -= n
+			units -= float64(n) * odFactor
+			taken[targetConfiguration{AvailabilityZone: od.az, InstanceType: od.key.instanceType}] += n
+		}
+		if len(taken) == 0 {
+			continue
+		}
+
+		targets := []targetConfiguration{}
+		add := func(instanceType string, count int64, az string) {
+			for i := range targets {
+				if targets[i].InstanceType == instanceType && targets[i].AvailabilityZone == az {
+					targets[i].InstanceCount += count
+					return
+				}
+			}
+			targets = append(targets, targetConfiguration{AvailabilityZone: az, InstanceCount: count, InstanceType: instanceType})
+		}
+
+		// the used part of the reservation stays as it is
+		if used > 0 {
+			add(key.instanceType, used, riAZ)
+		}
+
+		// what was taken moves to the AZ of the instances
+		configs := make([]targetConfiguration, 0, len(taken))
+		for c := range taken {
+			configs = append(configs, c)
+		}
+		sort.Slice(configs, func(i, j int) bool {
+			if configs[i].AvailabilityZone != configs[j].AvailabilityZone {
+				return configs[i].AvailabilityZone < configs[j].AvailabilityZone
+			}
+			return configs[i].InstanceType < configs[j].InstanceType
+		})
+		for _, c := range configs {
+			add(c.InstanceType, taken[c], c.AvailabilityZone)
+		}
+
+		// units left over stay with the reservation, in its own size if they divide
+		// evenly otherwise in the largest sizes of the family that fit
+		if flexible {
+			if n := int64(math.Floor(units / factor)); n > 0 {
+				add(key.instanceType, n, riAZ)
+				units -= float64(n) * factor
+			}
+			for _, size := range familySizes {
+				f := sizeFactors[size]
+				if n := int64(math.Floor(units / f)); n > 0 {
+					add(family+"."+size, n, riAZ)
+					units -= float64(n) * f
+				}
+			}
+		} else if n := int64(units); n > 0 {
+			add(key.instanceType, n, riAZ)
+		}
+
+		reason := fmt.Sprintf("%d of %d reserved %s unused while matching instances run on demand", unused, *ri.InstanceCount, key.instanceType)
+		mods = append(mods, &modification{
+			ReservationID:    id,
+			InstanceType:     key.instanceType,
+			AvailabilityZone: riAZ,
+			InstanceCount:    *ri.InstanceCount,
+			Unused:           unused,
+			Reason:           reason,
+			Request:          newModificationRequest([]string{id}, targets),
+		})
+	}
+	return mods
+}
+
+// newModificationRequest returns the request with a client token derived from its
+// contents. Submitting the same modification again is idempotent while a different
+// modification of the same reservation gets a new token
+func newModificationRequest(ids []string, targets []targetConfiguration) modificationRequest {
+
+	request := modificationRequest{ReservedInstancesIDs: ids, TargetConfigurations: targets}
+	contents, _ := json.Marshal(request)
+	sum := sha256.Sum256(contents)
+	request.ClientToken = hex.EncodeToString(sum[:])
+	return request
+}
+
+// printModifications displays each proposed modification and the request that would be submitted
+func printModifications(mods []*modification) {
+
+	fmt.Printf("Proposed reserved instance modifications\n\n")
+	if len(mods) == 0 {
+		fmt.Printf("No unused reservations can be moved onto on demand instances\n\n")
+		return
+	}
+
+	for _, m := range mods {
+		fmt.Printf("Reserved_instance: %s\tNum_of_instances: %d\tInstance_Type: %s\tAV-Zone: %s\tUnused: %d\n%s\n",
+			m.ReservationID, m.InstanceCount, m.InstanceType, m.AvailabilityZone, m.Unused, m.Reason)
+		request, _ := json.MarshalIndent(m.Request, "", "  ")
+		fmt.Printf("ModifyReservedInstances %s\n\n", request)
+	}
+	fmt.Printf("Use -apply -confirm to submit these modifications.\n\n")
+}
+
+// applyModifications submits the modifications. Without confirmed nothing is submitted
+func applyModifications(svc *ec2.EC2, mods []*modification, confirmed bool) error {
+
+	if !confirmed {
+		fmt.Printf("Not applied. Run again with -apply -confirm to submit %d modification(s)\n", len(mods))
+		return nil
+	}
+
+	failed := []string{}
+	for _, m := range mods {
+		targets := []*ec2.ReservedInstancesConfiguration{}
+		for _, t := range m.Request.TargetConfigurations {
+			target := &ec2.ReservedInstancesConfiguration{
+				InstanceCount:    aws.Long(t.InstanceCount),
+				InstanceType:     aws.String(t.InstanceType),
+				AvailabilityZone: aws.String(t.AvailabilityZone),
+			}
+			targets = append(targets, target)
+		}
+
+		resp, err := svc.ModifyReservedInstances(&ec2.ModifyReservedInstancesInput{
+			ClientToken:          aws.String(m.Request.ClientToken),
+			ReservedInstancesIDs: []*string{aws.String(m.ReservationID)},
+			TargetConfigurations: targets,
+		})
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", m.ReservationID, err))
+			continue
+		}
+		fmt.Printf("Modification %s submitted for %s\n", stringValue(resp.ReservedInstancesModificationID), m.ReservationID)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("modifications failed - %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+)
+
+func TestPlanModifications(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		ris       []*ec2.ReservedInstances
+		instances []*ec2.Instance
+		targets   map[string][]targetConfiguration
+	}{
+		{
+			name:      "zonal moves to where the instances run",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "us-east-1a", "Linux/UNIX", 2)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1b", ""), testInstance("m5.large", "us-east-1b", "")},
+			targets: map[string][]targetConfiguration{
+				"ri-1": {{AvailabilityZone: "us-east-1b", InstanceCount: 2, InstanceType: "m5.large"}},
+			},
+		},
+		{
+			name:      "zonal Linux changes size in normalized units",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.xlarge", "us-east-1a", "Linux/UNIX", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1a", "")},
+			targets: map[string][]targetConfiguration{
+				"ri-1": {{AvailabilityZone: "us-east-1a", InstanceCount: 2, InstanceType: "m5.large"}},
+			},
+		},
+		{
+			name: "Windows keeps the used part in its AZ",
+			ris:  []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "us-east-1a", "Windows", 2)},
+			instances: []*ec2.Instance{
+				testInstance("m5.large", "us-east-1a", "windows"),
+				testInstance("m5.large", "us-east-1b", "windows"),
+			},
+			targets: map[string][]targetConfiguration{
+				"ri-1": {
+					{AvailabilityZone: "us-east-1a", InstanceCount: 1, InstanceType: "m5.large"},
+					{AvailabilityZone: "us-east-1b", InstanceCount: 1, InstanceType: "m5.large"},
+				},
+			},
+		},
+		{
+			name:      "Windows does not change size",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.xlarge", "us-east-1a", "Windows", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1a", "windows")},
+			targets:   map[string][]targetConfiguration{},
+		},
+		{
+			name:      "regional Windows is left as it is",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "", "Windows", 2)},
+			instances: []*ec2.Instance{testInstance("c5.large", "us-east-1a", "windows")},
+			targets:   map[string][]targetConfiguration{},
+		},
+		{
+			name:      "regional Linux is left to AWS",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "", "Linux/UNIX", 2)},
+			instances: []*ec2.Instance{testInstance("c5.large", "us-east-1a", "")},
+			targets:   map[string][]targetConfiguration{},
+		},
+		{
+			name: "instances covered by a regional Linux reservation are not taken",
+			ris: []*ec2.ReservedInstances{
+				testReservation("ri-1", "m5.xlarge", "", "Linux/UNIX", 1),
+				testReservation("ri-2", "m5.large", "us-east-1a", "Linux/UNIX", 1),
+			},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1b", ""), testInstance("m5.large", "us-east-1b", "")},
+			targets:   map[string][]targetConfiguration{},
+		},
+	}
+
+	for _, test := range tests {
+		targets := map[string][]targetConfiguration{}
+		for _, m := range planModifications(test.ris, test.instances) {
+			targets[m.ReservationID] = m.Request.TargetConfigurations
+			if len(m.Request.ClientToken) != 64 {
+				t.Errorf("%s: client token %q is not 64 characters", test.name, m.Request.ClientToken)
+			}
+		}
+		if !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf("%s: targets %+v, want %+v", test.name, targets, test.targets)
+		}
+	}
+}
+
+func TestModificationClientToken(t *testing.T) {
+
+	zoneA := []targetConfiguration{{AvailabilityZone: "us-east-1a", InstanceCount: 2, InstanceType: "m5.large"}}
+	zoneB := []targetConfiguration{{AvailabilityZone: "us-east-1b", InstanceCount: 2, InstanceType: "m5.large"}}
+
+	first := newModificationRequest([]string{"ri-1"}, zoneA)
+	if again := newModificationRequest([]string{"ri-1"}, zoneA); again.ClientToken != first.ClientToken {
+		t.Errorf("same request gave tokens %s and %s", first.ClientToken, again.ClientToken)
+	}
+	if other := newModificationRequest([]string{"ri-1"}, zoneB); other.ClientToken == first.ClientToken {
+		t.Errorf("different targets gave the same token %s", first.ClientToken)
+	}
+	if other := newModificationRequest([]string{"ri-2"}, zoneA); other.ClientToken == first.ClientToken {
+		t.Errorf("different reservations gave the same token %s", first.ClientToken)
+	}
+}
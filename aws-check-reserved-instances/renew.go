@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+)
+
+// offeringCost is the price of a reservation or an offering
+type offeringCost struct {
+	OfferingID      string  `json:"offering_id,omitempty"`
+	OfferingType    string  `json:"offering_type"`
+	Duration        int64   `json:"duration_seconds"`
+	FixedPrice      float64 `json:"fixed_price"`
+	HourlyPrice     float64 `json:"hourly_price"`
+	EffectiveHourly float64 `json:"effective_hourly"`
+	SameTerm        bool    `json:"same_term"`
+}
+
+// renewal is an expiring EC2 reservation and the offerings that could replace it
+type renewal struct {
+	ReservationID      string         `json:"reservation_id"`
+	InstanceType       string         `json:"instance_type"`
+	ProductDescription string         `json:"product_description"`
+	Tenancy            string         `json:"tenancy"`
+	AvailabilityZone   string         `json:"availability_zone,omitempty"`
+	InstanceCount      int64          `json:"instance_count"`
+	Current            offeringCost   `json:"current"`
+	Offerings          []offeringCost `json:"offerings"`
+}
+
+// hourlyCharge adds the hourly recurring charges to the usage price
+func hourlyCharge(usagePrice *float64, charges []*ec2.RecurringCharge) float64 {
+
+	var hourly float64
+	if usagePrice != nil {
+		hourly = *usagePrice
+	}
+	for _, c := range charges {
+		if c.Amount != nil && stringValue(c.Frequency) == "Hourly" {
+			hourly += *c.Amount
+		}
+	}
+	return hourly
+}
+
+// effectiveHourly spreads the upfront price over the hours of the term
+func effectiveHourly(fixedPrice, hourly float64, duration int64) float64 {
+
+	hours := float64(duration) / 3600
+	if hours == 0 {
+		return hourly
+	}
+	return fixedPrice/hours + hourly
+}
+
+func floatValue(f *float64) float64 {
+	if f == nil {
+		return 0
+	}
+	return *f
+}
+
+// findOfferings returns the current AWS offerings for the same instance type, platform,
+// tenancy and AZ as the reservation, cheapest first. A reservation without an AZ is
+// regional and is shown the offerings for every AZ
+func findOfferings(svc *ec2.EC2, ri *ec2.ReservedInstances) ([]offeringCost, error) {
+
+	input := ec2.DescribeReservedInstancesOfferingsInput{
+		InstanceType:       ri.InstanceType,
+		ProductDescription: ri.ProductDescription,
+		InstanceTenancy:    ri.InstanceTenancy,
+		IncludeMarketplace: aws.Boolean(false),
+	}
+	// zonal reservations are replaced with offerings in the same AZ
+	if len(stringValue(ri.AvailabilityZone)) > 0 {
+		input.AvailabilityZone = ri.AvailabilityZone
+	}
+
+	offerings := []offeringCost{}
+	for {
+		resp, err := svc.DescribeReservedInstancesOfferings(&input)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range resp.ReservedInstancesOfferings {
+			hourly := hourlyCharge(o.UsagePrice, o.RecurringCharges)
+			offerings = append(offerings, offeringCost{
+				OfferingID:      stringValue(o.ReservedInstancesOfferingID),
+				OfferingType:    stringValue(o.OfferingType),
+				Duration:        int64Value(o.Duration),
+				FixedPrice:      floatValue(o.FixedPrice),
+				HourlyPrice:     hourly,
+				EffectiveHourly: effectiveHourly(floatValue(o.FixedPrice), hourly, int64Value(o.Duration)),
+				SameTerm:        int64Value(o.Duration) == int64Value(ri.Duration) && stringValue(o.OfferingType) == stringValue(ri.OfferingType),
+			})
+		}
+		if resp.NextToken == nil {
+			break
+		}
+		input.NextToken = resp.NextToken
+	}
+
+	sort.Slice(offerings, func(i, j int) bool { return offerings[i].EffectiveHourly < offerings[j].EffectiveHourly })
+	return offerings, nil
+}
+
+// renewalOptions finds the replacement offerings for each of the expiring reservations
+func renewalOptions(svc *ec2.EC2, ris []*ec2.ReservedInstances, expiring []reservationRow) ([]*renewal, error) {
+
+	byID := make(map[string]*ec2.ReservedInstances)
+	for _, ri := range ris {
+		byID[stringValue(ri.ReservedInstancesID)] = ri
+	}
+
+	renewals := []*renewal{}
+	for _, row := range expiring {
+		ri, found := byID[row.ReservationID]
+		if row.Service != "ec2" || row.DaysRemaining == nil || !found {
+			continue
+		}
+
+		offerings, err := findOfferings(svc, ri)
+		if err != nil {
+			return nil, fmt.Errorf("finding offerings for %s: %v", row.ReservationID, err)
+		}
+
+		hourly := hourlyCharge(ri.UsagePrice, ri.RecurringCharges)
+		renewals = append(renewals, &renewal{
+			ReservationID:      row.ReservationID,
+			InstanceType:       row.InstanceType,
+			ProductDescription: stringValue(ri.ProductDescription),
+			Tenancy:            stringValue(ri.InstanceTenancy),
+			AvailabilityZone:   row.AvailabilityZone,
+			InstanceCount:      row.InstanceCount,
+			Current: offeringCost{
+				OfferingType:    stringValue(ri.OfferingType),
+				Duration:        int64Value(ri.Duration),
+				FixedPrice:      floatValue(ri.FixedPrice),
+				HourlyPrice:     hourly,
+				EffectiveHourly: effectiveHourly(floatValue(ri.FixedPrice), hourly, int64Value(ri.Duration)),
+				SameTerm:        true,
+			},
+			Offerings: offerings,
+		})
+	}
+	return renewals, nil
+}
+
+// printRenewals displays the offerings for each expiring reservation against what it cost
+func printRenewals(renewals []*renewal) {
+
+	fmt.Printf("Renewal options for expiring reserved instances\n\n")
+
+	line := func(label string, c offeringCost) {
+		var same string
+		if c.SameTerm {
+			same = "*"
+		}
+		fmt.Printf("  %-38s %-16s %5s %12.2f %10.4f %10.4f %s\n", label, c.OfferingType,
+			termLength(c.Duration), c.FixedPrice, c.HourlyPrice, c.EffectiveHourly, same)
+	}
+
+	for _, r := range renewals {
+		fmt.Printf("Reserved_instance: %s\tNum_of_instances: %d\tInstance_Type: %s\t%s\t%s\t%s\n",
+			r.ReservationID, r.InstanceCount, r.InstanceType, r.ProductDescription, r.Tenancy, r.AvailabilityZone)
+		fmt.Printf("  %-38s %-16s %5s %12s %10s %10s\n", "Offering", "Type", "Term", "Upfront", "Hourly", "Effective")
+		line("current", r.Current)
+		if len(r.Offerings) == 0 {
+			fmt.Printf("  no matching offerings found\n")
+		}
+		for _, o := range r.Offerings {
+			line(o.OfferingID, o)
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Printf("* same term and payment option as the current reservation. Prices are per instance.\n")
+	fmt.Printf("Use -purchase offering-id -purchase-count n -confirm to buy an offering.\n\n")
+}
+
+// purchaseOffering buys count instances of the offering. Without confirmed it only
+// displays the offering and the request it would make
+func purchaseOffering(svc *ec2.EC2, offeringID string, count int64, confirmed bool) error {
+
+	resp, err := svc.DescribeReservedInstancesOfferings(&ec2.DescribeReservedInstancesOfferingsInput{
+		ReservedInstancesOfferingIDs: []*string{aws.String(offeringID)},
+		IncludeMarketplace:           aws.Boolean(false),
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.ReservedInstancesOfferings) == 0 {
+		return fmt.Errorf("offering %s not found", offeringID)
+	}
+	o := resp.ReservedInstancesOfferings[0]
+	hourly := hourlyCharge(o.UsagePrice, o.RecurringCharges)
+
+	fmt.Printf("Offering: %s\nInstance_Type: %s\t%s\t%s\t%s\nType: %s\tTerm: %s\n",
+		offeringID, stringValue(o.InstanceType), stringValue(o.ProductDescription), stringValue(o.InstanceTenancy),
+		stringValue(o.AvailabilityZone), stringValue(o.OfferingType), termLength(int64Value(o.Duration)))
+	fmt.Printf("Count: %d\tUpfront: %.2f\tHourly: %.4f\tTotal upfront: %.2f\n\n",
+		count, floatValue(o.FixedPrice), hourly, floatValue(o.FixedPrice)*float64(count))
+
+	if !confirmed {
+		fmt.Printf("Not purchased. Run again with -confirm to purchase %d of %s\n", count, offeringID)
+		return nil
+	}
+
+	purchase, err := svc.PurchaseReservedInstancesOffering(&ec2.PurchaseReservedInstancesOfferingInput{
+		ReservedInstancesOfferingID: aws.String(offeringID),
+		InstanceCount:               aws.Long(count),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purchased reserved instances %s\n", stringValue(purchase.ReservedInstancesID))
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+)
+
+// reservationRow is one reservation in the report. For services other than EC2
+// InstanceType is the node type. DaysRemaining is set for
+// reservations in the expiring window and DaysSinceExpiry for those in the retired
+// window. When the dates could not be read DateError says why
+type reservationRow struct {
+	Account          string    `json:"account"`
+	Region           string    `json:"region"`
+	Service          string    `json:"service"`
+	ReservationID    string    `json:"reservation_id"`
+	OfferingType     string    `json:"offering_type"`
+	State            string    `json:"state"`
+	InstanceType     string    `json:"instance_type"`
+	AvailabilityZone string    `json:"availability_zone"`
+	InstanceCount    int64     `json:"instance_count"`
+	Start            time.Time `json:"start"`
+	Duration         int64     `json:"duration_seconds"`
+	End              time.Time `json:"end"`
+	DaysRemaining    *int      `json:"days_remaining,omitempty"`
+	DaysSinceExpiry  *int      `json:"days_since_expiry,omitempty"`
+	DateError        string    `json:"date_error,omitempty"`
+}
+
+// rowGroup is the reservations sharing an instance type or availability zone
+type rowGroup struct {
+	Key           string           `json:"key"`
+	InstanceCount int64            `json:"instance_count"`
+	Reservations  []reservationRow `json:"reservations"`
+}
+
+// reservationReport is everything that is output in one run
+type reservationReport struct {
+	Reservations  []reservationRow `json:"reservations,omitempty"`
+	Groups        []rowGroup       `json:"groups,omitempty"`
+	Utilisation   []*usageRow      `json:"utilisation,omitempty"`
+	Renewals      []*renewal       `json:"renewals,omitempty"`
+	Modifications []*modification  `json:"modifications,omitempty"`
+}
+
+func newReservationRow(ri *ec2.ReservedInstances) reservationRow {
+
+	row := reservationRow{
+		Service:          "ec2",
+		ReservationID:    stringValue(ri.ReservedInstancesID),
+		OfferingType:     stringValue(ri.OfferingType),
+		State:            stringValue(ri.State),
+		InstanceType:     stringValue(ri.InstanceType),
+		AvailabilityZone: stringValue(ri.AvailabilityZone),
+	}
+	if ri.InstanceCount != nil {
+		row.InstanceCount = *ri.InstanceCount
+	}
+	if ri.Start != nil {
+		row.Start = *ri.Start
+	}
+	row.Duration = int64Value(ri.Duration)
+	if ri.End != nil {
+		row.End = *ri.End
+	} else {
+		row.DateError = "no end date"
+	}
+	return row
+}
+
+// selectRows returns the active reservations that expire within expireDays and the
+// retired reservations that expired within the last retireDays, with the exact number
+// of days set. Reservations with dates that could not be read are always returned so
+// they are not silently missed
+func selectRows(reservations []reservationRow, expireDays, retireDays int, now time.Time) []reservationRow {
+
+	rows := []reservationRow{}
+
+	for _, row := range reservations {
+		if len(row.DateError) > 0 {
+			rows = append(rows, row)
+			continue
+		}
+
+		remaining := row.End.Sub(now)
+
+		if expireDays > 0 && row.State == "active" && remaining <= time.Duration(expireDays)*24*time.Hour {
+			// part of a day left counts as a day
+			days := int(math.Ceil(remaining.Hours() / 24))
+			row.DaysRemaining = &days
+			rows = append(rows, row)
+		}
+
+		if retireDays > 0 && row.State == "retired" && -remaining <= time.Duration(retireDays)*24*time.Hour {
+			days := int(math.Floor(-remaining.Hours() / 24))
+			row.DaysSinceExpiry = &days
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// termLength describes a term in seconds as years, or days when it is not whole years
+func termLength(seconds int64) string {
+
+	const year = 365 * 24 * 60 * 60
+
+	switch {
+	case seconds == 0:
+		return ""
+	case seconds%year == 0:
+		return fmt.Sprintf("%dy", seconds/year)
+	default:
+		return fmt.Sprintf("%dd", seconds/(24*60*60))
+	}
+}
+
+// formatDate returns the time as RFC3339 or an empty string for the zero time
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// formatDays returns the number of days or an empty string if it is not set
+func formatDays(days *int) string {
+	if days == nil {
+		return ""
+	}
+	return strconv.Itoa(*days)
+}
+
+// sortByExpiry orders the rows with the soonest expiry first
+func sortByExpiry(rows []reservationRow) {
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].End.Before(rows[j].End) })
+}
+
+// groupRows groups the rows by "type" or "az" keeping the order of the rows within
+// each group. Groups are sorted by key
+func groupRows(rows []reservationRow, groupBy string) []rowGroup {
+
+	index := map[string]int{}
+	groups := []rowGroup{}
+
+	for _, row := range rows {
+		key := row.InstanceType
+		if groupBy == "az" {
+			key = row.AvailabilityZone
+			// regional reservations have no availability zone
+			if len(key) == 0 {
+				key = "region"
+			}
+		}
+
+		i, found := index[key]
+		if !found {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, rowGroup{Key: key})
+		}
+		groups[i].InstanceCount += row.InstanceCount
+		groups[i].Reservations = append(groups[i].Reservations, row)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Key < groups[j].Key })
+	return groups
+}
+
+// printText displays the report in the original two line per reservation format
+func (r *reservationReport) printText(w io.Writer, groupBy string) {
+
+	printRows := func(rows []reservationRow) {
+		for _, row := range rows {
+			var days string
+			switch {
+			case len(row.DateError) > 0:
+				days = "Date_error: " + row.DateError
+			case row.DaysRemaining != nil:
+				days = fmt.Sprintf("Days_remaining: %d", *row.DaysRemaining)
+			case row.DaysSinceExpiry != nil:
+				days = fmt.Sprintf("Days_since_expiry: %d", *row.DaysSinceExpiry)
+			}
+			fmt.Fprintf(w, "Account: %s\tRegion: %s\tService: %s\tReserved_instance: %s\tOffer_Type: %s\tState: %s\nNum_of_instances: %d\tInstance_Type: %s\tAV-Zone: %s\tStart: %s\tTerm: %s\tExpire: %s\t%s\n\n",
+				row.Account, row.Region, row.Service, row.ReservationID, row.OfferingType, row.State, row.InstanceCount, row.InstanceType, row.AvailabilityZone,
+				formatDate(row.Start), termLength(row.Duration), formatDate(row.End), days)
+		}
+	}
+
+	if len(r.Groups) > 0 {
+		label := "Instance_Type"
+		if groupBy == "az" {
+			label = "AV-Zone"
+		}
+		for _, g := range r.Groups {
+			fmt.Fprintf(w, "%s: %s\tTotal_instances: %d\n\n", label, g.Key, g.InstanceCount)
+			printRows(g.Reservations)
+		}
+	} else {
+		printRows(r.Reservations)
+	}
+
+	if len(r.Utilisation) > 0 {
+		printUtilisation(r.Utilisation)
+	}
+
+	if len(r.Renewals) > 0 {
+		printRenewals(r.Renewals)
+	}
+
+	if r.Modifications != nil {
+		printModifications(r.Modifications)
+	}
+}
+
+// writeJSON writes the report as JSON
+func (r *reservationReport) writeJSON(w io.Writer) error {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeCSV writes one line per reservation. When grouped each line starts with the
+// group key and each group is followed by a total line
+func (r *reservationReport) writeCSV(w io.Writer) error {
+
+	out := csv.NewWriter(w)
+
+	header := []string{"account", "region", "service", "reservation_id", "offering_type", "state", "instance_type", "availability_zone", "instance_count",
+		"start", "term", "end", "days_remaining", "days_since_expiry", "date_error"}
+	record := func(row reservationRow) []string {
+		return []string{row.Account, row.Region, row.Service, row.ReservationID, row.OfferingType, row.State, row.InstanceType, row.AvailabilityZone,
+			strconv.FormatInt(row.InstanceCount, 10), formatDate(row.Start), termLength(row.Duration), formatDate(row.End),
+			formatDays(row.DaysRemaining), formatDays(row.DaysSinceExpiry), row.DateError}
+	}
+
+	if len(r.Groups) > 0 {
+		out.Write(append([]string{"group"}, header...))
+		for _, g := range r.Groups {
+			for _, row := range g.Reservations {
+				out.Write(append([]string{g.Key}, record(row)...))
+			}
+			out.Write([]string{g.Key, "", "", "", "total", "", "", "", "", strconv.FormatInt(g.InstanceCount, 10), "", "", "", "", "", ""})
+		}
+	} else {
+		out.Write(header)
+		for _, row := range r.Reservations {
+			out.Write(record(row))
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
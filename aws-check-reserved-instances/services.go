@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+	"github.com/awslabs/aws-sdk-go/service/elasticache"
+	"github.com/awslabs/aws-sdk-go/service/rds"
+	"github.com/awslabs/aws-sdk-go/service/redshift"
+)
+
+// allServices is every service with reservations in the order they are reported
+var allServices = []string{"ec2", "rds", "elasticache", "redshift"}
+
+// reservationSource lists the reservations of one service as report rows
+type reservationSource func(config *aws.Config) ([]reservationRow, error)
+
+var reservationSources = map[string]reservationSource{
+	"rds":         rdsReservations,
+	"elasticache": elasticacheReservations,
+	"redshift":    redshiftReservations,
+}
+
+// int64Value returns the value or 0 if it is nil
+func int64Value(i *int64) int64 {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+// setTerm sets the start, duration and end of a reservation that only reports its
+// start and duration in seconds
+func (row *reservationRow) setTerm(start *time.Time, duration *int64) {
+
+	if start == nil || duration == nil {
+		row.DateError = "no start time or duration"
+		return
+	}
+	row.Start = *start
+	row.Duration = *duration
+	row.End = start.Add(time.Duration(*duration) * time.Second)
+}
+
+// ec2Reservations returns every EC2 reserved instance
+func ec2Reservations(svc *ec2.EC2) ([]*ec2.ReservedInstances, error) {
+
+	resp, err := svc.DescribeReservedInstances(&ec2.DescribeReservedInstancesInput{})
+	if awserr := aws.Error(err); awserr != nil {
+		return nil, fmt.Errorf("%s - %s", awserr.Code, awserr.Message)
+	} else if err != nil {
+		return nil, err
+	}
+	return resp.ReservedInstances, nil
+}
+
+func rdsReservations(config *aws.Config) ([]reservationRow, error) {
+
+	svc := rds.New(config)
+	rows := []reservationRow{}
+	input := rds.DescribeReservedDBInstancesInput{}
+
+	for {
+		resp, err := svc.DescribeReservedDBInstances(&input)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.ReservedDBInstances {
+			row := reservationRow{
+				Service:       "rds",
+				ReservationID: stringValue(r.ReservedDBInstanceID),
+				OfferingType:  stringValue(r.OfferingType),
+				State:         stringValue(r.State),
+				InstanceType:  stringValue(r.DBInstanceClass),
+				InstanceCount: int64Value(r.DBInstanceCount),
+			}
+			row.setTerm(r.StartTime, r.Duration)
+			rows = append(rows, row)
+		}
+		if resp.Marker == nil {
+			return rows, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
+
+func elasticacheReservations(config *aws.Config) ([]reservationRow, error) {
+
+	svc := elasticache.New(config)
+	rows := []reservationRow{}
+	input := elasticache.DescribeReservedCacheNodesInput{}
+
+	for {
+		resp, err := svc.DescribeReservedCacheNodes(&input)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.ReservedCacheNodes {
+			row := reservationRow{
+				Service:       "elasticache",
+				ReservationID: stringValue(r.ReservedCacheNodeID),
+				OfferingType:  stringValue(r.OfferingType),
+				State:         stringValue(r.State),
+				InstanceType:  stringValue(r.CacheNodeType),
+				InstanceCount: int64Value(r.CacheNodeCount),
+			}
+			row.setTerm(r.StartTime, r.Duration)
+			rows = append(rows, row)
+		}
+		if resp.Marker == nil {
+			return rows, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
+
+func redshiftReservations(config *aws.Config) ([]reservationRow, error) {
+
+	svc := redshift.New(config)
+	rows := []reservationRow{}
+	input := redshift.DescribeReservedNodesInput{}
+
+	for {
+		resp, err := svc.DescribeReservedNodes(&input)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.ReservedNodes {
+			row := reservationRow{
+				Service:       "redshift",
+				ReservationID: stringValue(r.ReservedNodeID),
+				OfferingType:  stringValue(r.OfferingType),
+				State:         stringValue(r.State),
+				InstanceType:  stringValue(r.NodeType),
+				InstanceCount: int64Value(r.NodeCount),
+			}
+			row.setTerm(r.StartTime, r.Duration)
+			rows = append(rows, row)
+		}
+		if resp.Marker == nil {
+			return rows, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+	"github.com/awslabs/aws-sdk-go/service/sts"
+)
+
+// sweepTarget is one account and region to check. The account is the profile name,
+// the account id of the assumed role or default
+type sweepTarget struct {
+	account string
+	region  string
+	profile string
+	roleARN string
+}
+
+// sweepResult is the reservations found for one target and anything that failed
+type sweepResult struct {
+	target      sweepTarget
+	config      *aws.Config
+	rows        []reservationRow
+	ec2Reserved []*ec2.ReservedInstances
+	errors      []string
+}
+
+// splitList splits a comma separated list ignoring empty and repeated entries
+func splitList(list string) []string {
+
+	items := []string{}
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 && !seen[item] {
+			seen[item] = true
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// roleAccount returns the account id from a role ARN arn:aws:iam::123456789012:role/name
+func roleAccount(roleARN string) string {
+
+	parts := strings.Split(roleARN, ":")
+	if len(parts) < 5 || len(parts[4]) == 0 {
+		return roleARN
+	}
+	return parts[4]
+}
+
+// sweepTargets returns every combination of account and region to check. Roles are
+// assumed using the credentials of profile. With no lists there is a single target
+// for regionName and profile
+func sweepTargets(regionName, profile, regionList, profileList, roleList string) []sweepTarget {
+
+	regions := splitList(regionList)
+	if len(regions) == 0 {
+		regions = []string{regionName}
+	}
+
+	accounts := []sweepTarget{}
+	for _, p := range splitList(profileList) {
+		accounts = append(accounts, sweepTarget{account: p, profile: p})
+	}
+	for _, role := range splitList(roleList) {
+		accounts = append(accounts, sweepTarget{account: roleAccount(role), profile: profile, roleARN: role})
+	}
+	if len(accounts) == 0 {
+		account := profile
+		if len(account) == 0 {
+			account = "default"
+		}
+		accounts = append(accounts, sweepTarget{account: account, profile: profile})
+	}
+
+	targets := []sweepTarget{}
+	for _, a := range accounts {
+		for _, region := range regions {
+			t := a
+			t.region = region
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// targetConfig builds the config for the target, assuming the role if there is one
+func targetConfig(t sweepTarget) (*aws.Config, error) {
+
+	config, err := awsConfig(t.region, t.profile)
+	if err != nil || len(t.roleARN) == 0 {
+		return config, err
+	}
+
+	resp, err := sts.New(config).AssumeRole(&sts.AssumeRoleInput{
+		RoleARN:         aws.String(t.roleARN),
+		RoleSessionName: aws.String("aws-check-reserved-instances"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to assume role %s: %v", t.roleARN, err)
+	}
+
+	return &aws.Config{
+		Credentials: aws.Creds(*resp.Credentials.AccessKeyID, *resp.Credentials.SecretAccessKey, *resp.Credentials.SessionToken),
+		Region:      config.Region,
+	}, nil
+}
+
+// sweepReservations lists the reservations of every service for the target. A service
+// that fails is recorded and the others are still checked
+func sweepReservations(t sweepTarget, services []string) *sweepResult {
+
+	result := &sweepResult{target: t}
+
+	config, err := targetConfig(t)
+	if err != nil {
+		result.errors = append(result.errors, err.Error())
+		return result
+	}
+	result.config = config
+	result.target.region = config.Region
+
+	for _, service := range services {
+		var rows []reservationRow
+		if service == "ec2" {
+			result.ec2Reserved, err = ec2Reservations(ec2.New(config))
+			for _, ri := range result.ec2Reserved {
+				rows = append(rows, newReservationRow(ri))
+			}
+		} else {
+			rows, err = reservationSources[service](config)
+		}
+		if err != nil {
+			result.errors = append(result.errors, fmt.Sprintf("listing %s reservations: %v", service, err))
+			continue
+		}
+		for _, row := range rows {
+			row.Account = t.account
+			row.Region = config.Region
+			result.rows = append(result.rows, row)
+		}
+	}
+	return result
+}
+
+// reservationKey identifies a reservation across targets. EC2 reservation ids are unique
+// on their own so two profiles or roles for the same account give the same key. The
+// other services use names chosen by the customer, and account is only the profile or
+// role label, so they are only told apart within a label
+func reservationKey(account, region, service, id string) string {
+	if service == "ec2" {
+		account = ""
+	}
+	return strings.Join([]string{account, region, service, id}, "/")
+}
+
+// sweepAll checks the targets with at most concurrency running at once. The results
+// are in the same order as the targets. A reservation reached through more than one
+// target, such as two roles in the same account, is only kept the first time so it
+// is reported and announced once. Only EC2 reservations are recognised across targets,
+// see reservationKey
+func sweepAll(targets []sweepTarget, services []string, concurrency int) []*sweepResult {
+
+	results := make([]*sweepResult, len(targets))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, t := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, t sweepTarget) {
+			defer wg.Done()
+			results[i] = sweepReservations(t, services)
+			<-slots
+		}(i, t)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, r := range results {
+		rows := []reservationRow{}
+		for _, row := range r.rows {
+			key := reservationKey(row.Account, row.Region, row.Service, row.ReservationID)
+			if !seen[key] {
+				seen[key] = true
+				rows = append(rows, row)
+			}
+		}
+		r.rows = rows
+	}
+	return results
+}
+
+// printSweepErrors displays the errors grouped by region and returns true if there were any
+func printSweepErrors(w io.Writer, results []*sweepResult) bool {
+
+	byRegion := make(map[string][]string)
+	for _, r := range results {
+		for _, e := range r.errors {
+			byRegion[r.target.region] = append(byRegion[r.target.region], fmt.Sprintf("%s: %s", r.target.account, e))
+		}
+	}
+	if len(byRegion) == 0 {
+		return false
+	}
+
+	regions := make([]string, 0, len(byRegion))
+	for region := range byRegion {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	fmt.Fprintf(w, "Errors by region\n")
+	for _, region := range regions {
+		name := region
+		if len(name) == 0 {
+			name = "(no region)"
+		}
+		fmt.Fprintf(w, "%s: %d error(s)\n", name, len(byRegion[region]))
+		for _, e := range byRegion[region] {
+			fmt.Fprintf(w, "  %s\n", e)
+		}
+	}
+	return true
+}
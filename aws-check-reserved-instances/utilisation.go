@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+)
+
+// usageKey is what a reservation and a running instance must share for the
+// reservation to apply to the instance
+type usageKey struct {
+	instanceType string
+	platform     string
+	tenancy      string
+}
+
+// usageRow is the utilisation and coverage for one instance type. A size flexible
+// reservation can cover part of a larger instance so Covered, Unused and OnDemand
+// can be fractional
+type usageRow struct {
+	InstanceType string  `json:"instance_type"`
+	Reserved     int64   `json:"reserved"`
+	Running      int64   `json:"running"`
+	Covered      float64 `json:"covered"`
+	Unused       float64 `json:"unused"`
+	OnDemand     float64 `json:"on_demand"`
+}
+
+// riPlatform converts the reservation product description to the platform of the
+// instances it applies to
+func riPlatform(productDescription string) string {
+	return strings.TrimSuffix(productDescription, " (Amazon VPC)")
+}
+
+// instancePlatform returns the platform of a running instance in the same form as
+// riPlatform. The SDK only reports whether an instance runs Windows, so instances are
+// Windows or Linux/UNIX. Reservations for other platforms such as Red Hat, SUSE or SQL
+// Server never match a running instance and instances running them are counted as
+// Windows or Linux/UNIX
+func instancePlatform(instance *ec2.Instance) string {
+	if stringValue(instance.Platform) == "windows" {
+		return "Windows"
+	}
+	return "Linux/UNIX"
+}
+
+// sizeFactors are the normalization factors AWS uses to compare instance sizes
+// within a family. An Nxlarge is N times an xlarge
+var sizeFactors = map[string]float64{
+	"nano":   0.25,
+	"micro":  0.5,
+	"small":  1,
+	"medium": 2,
+	"large":  4,
+	"xlarge": 8,
+}
+
+// normalizationFactor splits the instance type into its family and the normalization
+// factor of its size. ok is false for sizes such as metal that have no factor
+func normalizationFactor(instanceType string) (family string, factor float64, ok bool) {
+
+	parts := strings.SplitN(instanceType, ".", 2)
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+	family, size := parts[0], parts[1]
+
+	if factor, ok = sizeFactors[size]; ok {
+		return family, factor, true
+	}
+	if strings.HasSuffix(size, "xlarge") {
+		n, err := strconv.Atoi(strings.TrimSuffix(size, "xlarge"))
+		if err == nil && n > 0 {
+			return family, float64(n) * sizeFactors["xlarge"], true
+		}
+	}
+	return family, 0, false
+}
+
+// sizeFlexible returns true if AWS applies the reservation to any size in its family.
+// This is the case for regional Linux/UNIX reservations with default tenancy
+func sizeFlexible(ri *ec2.ReservedInstances) bool {
+	_, _, ok := normalizationFactor(stringValue(ri.InstanceType))
+	return ok && len(stringValue(ri.AvailabilityZone)) == 0 &&
+		riPlatform(stringValue(ri.ProductDescription)) == "Linux/UNIX" && stringValue(ri.InstanceTenancy) == "default"
+}
+
+// instanceTenancy returns the tenancy of a running instance
+func instanceTenancy(instance *ec2.Instance) string {
+	if instance.Placement == nil || instance.Placement.Tenancy == nil {
+		return "default"
+	}
+	return *instance.Placement.Tenancy
+}
+
+// runningInstances returns all running on-demand instances. Spot instances can not
+// use a reservation so they are left out
+func runningInstances(svc *ec2.EC2) ([]*ec2.Instance, error) {
+
+	instances := []*ec2.Instance{}
+
+	ec2dii := ec2.DescribeInstancesInput{Filters: []*ec2.Filter{&ec2.Filter{
+		Name:   aws.String("instance-state-name"),
+		Values: []*string{aws.String("running")}}}}
+
+	for {
+		resp, err := svc.DescribeInstances(&ec2dii)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				if stringValue(instance.InstanceLifecycle) == "spot" {
+					continue
+				}
+				instances = append(instances, instance)
+			}
+		}
+		if resp.NextToken == nil {
+			return instances, nil
+		}
+		ec2dii.NextToken = resp.NextToken
+	}
+}
+
+// reservationMatch is the result of matching the active reservations against the
+// running instances
+type reservationMatch struct {
+	// instances of its own type covered by each reservation id. A size flexible
+	// reservation can cover part of a larger instance so this can be fractional
+	used map[string]float64
+	// running instances not covered by a reservation, by key then AZ. An instance
+	// partly covered by a size flexible reservation counts as the part left
+	uncovered map[usageKey]map[string]float64
+}
+
+// riKey returns the key of the instances the reservation applies to
+func riKey(ri *ec2.ReservedInstances) usageKey {
+	return usageKey{stringValue(ri.InstanceType), riPlatform(stringValue(ri.ProductDescription)), stringValue(ri.InstanceTenancy)}
+}
+
+// matchReservations matches the active reservations against the running instances the
+// way AWS applies them. Zonal reservations are applied first as they only cover their
+// own AZ, then regional reservations for a single instance type. Last size flexible
+// regional reservations cover any size in their family in normalized units, smallest
+// instances first
+func matchReservations(ris []*ec2.ReservedInstances, instances []*ec2.Instance) *reservationMatch {
+
+	match := &reservationMatch{
+		used:      make(map[string]float64),
+		uncovered: make(map[usageKey]map[string]float64),
+	}
+
+	for _, instance := range instances {
+		key := usageKey{stringValue(instance.InstanceType), instancePlatform(instance), instanceTenancy(instance)}
+		if match.uncovered[key] == nil {
+			match.uncovered[key] = make(map[string]float64)
+		}
+		az := ""
+		if instance.Placement != nil {
+			az = stringValue(instance.Placement.AvailabilityZone)
+		}
+		match.uncovered[key][az]++
+	}
+
+	active := []*ec2.ReservedInstances{}
+	for _, ri := range ris {
+		if stringValue(ri.State) == "active" && ri.InstanceCount != nil {
+			active = append(active, ri)
+		}
+	}
+
+	// zonal reservations then regional reservations for one instance type
+	for _, zonal := range []bool{true, false} {
+		for _, ri := range active {
+			az := stringValue(ri.AvailabilityZone)
+			if (len(az) > 0) != zonal || sizeFlexible(ri) {
+				continue
+			}
+
+			key := riKey(ri)
+			remaining := float64(*ri.InstanceCount)
+			for _, instanceAZ := range sortedAZs(match.uncovered[key]) {
+				if remaining == 0 {
+					break
+				}
+				if zonal && instanceAZ != az {
+					continue
+				}
+				used := math.Min(match.uncovered[key][instanceAZ], remaining)
+				match.uncovered[key][instanceAZ] -= used
+				remaining -= used
+				match.used[stringValue(ri.ReservedInstancesID)] += used
+			}
+		}
+	}
+
+	// size flexible reservations cover their family in normalized units
+	for _, ri := range active {
+		if !sizeFlexible(ri) {
+			continue
+		}
+		key := riKey(ri)
+		family, factor, _ := normalizationFactor(key.instanceType)
+
+		// the instances in the family smallest first
+		candidates := []usageKey{}
+		for k := range match.uncovered {
+			f, kFactor, ok := normalizationFactor(k.instanceType)
+			if ok && f == family && k.platform == key.platform && k.tenancy == key.tenancy && kFactor > 0 {
+				candidates = append(candidates, k)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			_, fi, _ := normalizationFactor(candidates[i].instanceType)
+			_, fj, _ := normalizationFactor(candidates[j].instanceType)
+			if fi != fj {
+				return fi < fj
+			}
+			return candidates[i].instanceType < candidates[j].instanceType
+		})
+
+		units := float64(*ri.InstanceCount) * factor
+		for _, k := range candidates {
+			_, kFactor, _ := normalizationFactor(k.instanceType)
+			for _, az := range sortedAZs(match.uncovered[k]) {
+				if units == 0 {
+					break
+				}
+				used := math.Min(match.uncovered[k][az]*kFactor, units)
+				match.uncovered[k][az] -= used / kFactor
+				units -= used
+			}
+		}
+		match.used[stringValue(ri.ReservedInstancesID)] += float64(*ri.InstanceCount) - units/factor
+	}
+	return match
+}
+
+// sortedAZs returns the AZs of the instance counts in order so matching is the same every run
+func sortedAZs(counts map[string]float64) []string {
+	azs := make([]string, 0, len(counts))
+	for az := range counts {
+		azs = append(azs, az)
+	}
+	sort.Strings(azs)
+	return azs
+}
+
+// computeUtilisation reports, per instance type, how many reserved units are used and
+// how many running instances are on demand
+func computeUtilisation(ris []*ec2.ReservedInstances, instances []*ec2.Instance) []*usageRow {
+
+	rows := make(map[string]*usageRow)
+	row := func(instanceType string) *usageRow {
+		if _, ok := rows[instanceType]; !ok {
+			rows[instanceType] = &usageRow{InstanceType: instanceType}
+		}
+		return rows[instanceType]
+	}
+
+	for _, instance := range instances {
+		row(stringValue(instance.InstanceType)).Running++
+	}
+
+	match := matchReservations(ris, instances)
+	for key, azs := range match.uncovered {
+		for _, count := range azs {
+			row(key.instanceType).OnDemand += count
+		}
+	}
+
+	for _, ri := range ris {
+		if stringValue(ri.State) != "active" || ri.InstanceCount == nil {
+			continue
+		}
+		r := row(stringValue(ri.InstanceType))
+		r.Reserved += *ri.InstanceCount
+		r.Unused += float64(*ri.InstanceCount) - match.used[stringValue(ri.ReservedInstancesID)]
+	}
+
+	result := []*usageRow{}
+	for _, r := range rows {
+		r.Covered = float64(r.Running) - r.OnDemand
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].InstanceType < result[j].InstanceType })
+	return result
+}
+
+// printUtilisation displays the utilisation and coverage report
+func printUtilisation(rows []*usageRow) {
+
+	fmt.Printf("Reserved instance utilisation and coverage\n\n")
+	fmt.Printf("%-16s %9s %9s %9s %9s %10s\n", "Instance_Type", "Reserved", "Running", "Covered", "Unused", "On_demand")
+
+	for _, r := range rows {
+		fmt.Printf("%-16s %9d %9d %9.2f %9.2f %10.2f\n", r.InstanceType, r.Reserved, r.Running, r.Covered, r.Unused, r.OnDemand)
+	}
+	fmt.Printf("\nRegional Linux/UNIX reservations with default tenancy cover any size in their family,\nso part of an instance can be covered.\n")
+	fmt.Printf("Unused reservations can be modified to match on demand instances. On demand\ninstances that run all the time are candidates for new reservations.\n")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/ec2"
+)
+
+// testReservation returns an active reservation with default tenancy
+func testReservation(id, instanceType, az, description string, count int64) *ec2.ReservedInstances {
+	ri := &ec2.ReservedInstances{
+		ReservedInstancesID: aws.String(id),
+		InstanceType:        aws.String(instanceType),
+		ProductDescription:  aws.String(description),
+		InstanceCount:       aws.Long(count),
+		InstanceTenancy:     aws.String("default"),
+		State:               aws.String("active"),
+	}
+	if len(az) > 0 {
+		ri.AvailabilityZone = aws.String(az)
+	}
+	return ri
+}
+
+// testInstance returns a running instance with default tenancy. platform is windows
+// or empty for Linux/UNIX
+func testInstance(instanceType, az, platform string) *ec2.Instance {
+	instance := &ec2.Instance{
+		InstanceType: aws.String(instanceType),
+		Placement:    &ec2.Placement{AvailabilityZone: aws.String(az)},
+	}
+	if len(platform) > 0 {
+		instance.Platform = aws.String(platform)
+	}
+	return instance
+}
+
+// remaining drops the AZs with nothing left uncovered
+func remaining(uncovered map[usageKey]map[string]float64) map[usageKey]map[string]float64 {
+	result := make(map[usageKey]map[string]float64)
+	for key, azs := range uncovered {
+		for az, count := range azs {
+			if count == 0 {
+				continue
+			}
+			if result[key] == nil {
+				result[key] = make(map[string]float64)
+			}
+			result[key][az] = count
+		}
+	}
+	return result
+}
+
+func TestMatchReservations(t *testing.T) {
+
+	linux := func(instanceType string) usageKey { return usageKey{instanceType, "Linux/UNIX", "default"} }
+
+	dedicated := testReservation("ri-dedicated", "m5.xlarge", "", "Linux/UNIX", 1)
+	dedicated.InstanceTenancy = aws.String("dedicated")
+	dedicatedInstance := testInstance("m5.large", "us-east-1a", "")
+	dedicatedInstance.Placement.Tenancy = aws.String("dedicated")
+
+	tests := []struct {
+		name      string
+		ris       []*ec2.ReservedInstances
+		instances []*ec2.Instance
+		used      map[string]float64
+		uncovered map[usageKey]map[string]float64
+	}{
+		{
+			name: "zonal covers its own AZ",
+			ris:  []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "us-east-1a", "Linux/UNIX", 2)},
+			instances: []*ec2.Instance{
+				testInstance("m5.large", "us-east-1a", ""),
+				testInstance("m5.large", "us-east-1a", ""),
+				testInstance("m5.large", "us-east-1a", ""),
+			},
+			used:      map[string]float64{"ri-1": 2},
+			uncovered: map[usageKey]map[string]float64{linux("m5.large"): {"us-east-1a": 1}},
+		},
+		{
+			name:      "zonal does not cover another AZ",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "us-east-1a", "Linux/UNIX (Amazon VPC)", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1b", "")},
+			used:      map[string]float64{},
+			uncovered: map[usageKey]map[string]float64{linux("m5.large"): {"us-east-1b": 1}},
+		},
+		{
+			name:      "regional Windows in a VPC",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "", "Windows (Amazon VPC)", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1b", "windows")},
+			used:      map[string]float64{"ri-1": 1},
+			uncovered: map[usageKey]map[string]float64{},
+		},
+		{
+			name:      "Windows does not cover Linux",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "us-east-1a", "Windows", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1a", "")},
+			used:      map[string]float64{},
+			uncovered: map[usageKey]map[string]float64{linux("m5.large"): {"us-east-1a": 1}},
+		},
+		{
+			name:      "Red Hat can not be matched",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "", "Red Hat Enterprise Linux", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1b", "")},
+			used:      map[string]float64{},
+			uncovered: map[usageKey]map[string]float64{linux("m5.large"): {"us-east-1b": 1}},
+		},
+		{
+			name:      "Windows with SQL Server can not be matched",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "us-east-1a", "Windows with SQL Server Standard (Amazon VPC)", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1a", "windows")},
+			used:      map[string]float64{},
+			uncovered: map[usageKey]map[string]float64{{"m5.large", "Windows", "default"}: {"us-east-1a": 1}},
+		},
+		{
+			name: "regional Linux covers the family smallest first",
+			ris:  []*ec2.ReservedInstances{testReservation("ri-1", "m5.xlarge", "", "Linux/UNIX", 1)},
+			instances: []*ec2.Instance{
+				testInstance("m5.2xlarge", "us-east-1b", ""),
+				testInstance("m5.large", "us-east-1a", ""),
+			},
+			used:      map[string]float64{"ri-1": 1},
+			uncovered: map[usageKey]map[string]float64{linux("m5.2xlarge"): {"us-east-1b": 0.75}},
+		},
+		{
+			name:      "regional Linux partly used",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.2xlarge", "", "Linux/UNIX", 1)},
+			instances: []*ec2.Instance{testInstance("m5.large", "us-east-1a", ""), testInstance("m5.large", "us-east-1b", "")},
+			used:      map[string]float64{"ri-1": 0.5},
+			uncovered: map[usageKey]map[string]float64{},
+		},
+		{
+			name:      "regional Linux does not cover another family",
+			ris:       []*ec2.ReservedInstances{testReservation("ri-1", "m5.large", "", "Linux/UNIX", 1)},
+			instances: []*ec2.Instance{testInstance("c5.large", "us-east-1a", "")},
+			used:      map[string]float64{"ri-1": 0},
+			uncovered: map[usageKey]map[string]float64{linux("c5.large"): {"us-east-1a": 1}},
+		},
+		{
+			name:      "dedicated tenancy is not size flexible",
+			ris:       []*ec2.ReservedInstances{dedicated},
+			instances: []*ec2.Instance{dedicatedInstance},
+			used:      map[string]float64{},
+			uncovered: map[usageKey]map[string]float64{{"m5.large", "Linux/UNIX", "dedicated"}: {"us-east-1a": 1}},
+		},
+	}
+
+	for _, test := range tests {
+		match := matchReservations(test.ris, test.instances)
+		if !reflect.DeepEqual(match.used, test.used) {
+			t.Errorf("%s: used %v, want %v", test.name, match.used, test.used)
+		}
+		if uncovered := remaining(match.uncovered); !reflect.DeepEqual(uncovered, test.uncovered) {
+			t.Errorf("%s: uncovered %v, want %v", test.name, uncovered, test.uncovered)
+		}
+	}
+}
+
+func TestComputeUtilisation(t *testing.T) {
+
+	ris := []*ec2.ReservedInstances{testReservation("ri-1", "m5.2xlarge", "", "Linux/UNIX", 1)}
+	instances := []*ec2.Instance{
+		testInstance("m5.large", "us-east-1a", ""),
+		testInstance("m5.4xlarge", "us-east-1a", ""),
+	}
+
+	want := []*usageRow{
+		{InstanceType: "m5.2xlarge", Reserved: 1},
+		{InstanceType: "m5.4xlarge", Running: 1, Covered: 0.375, OnDemand: 0.625},
+		{InstanceType: "m5.large", Running: 1, Covered: 1},
+	}
+	if got := computeUtilisation(ris, instances); !reflect.DeepEqual(got, want) {
+		for _, r := range got {
+			t.Logf("%+v", *r)
+		}
+		t.Errorf("utilisation does not match")
+	}
+}
@@ -1,27 +1,119 @@
 /*
 This application will deregister AMI's and associated snapshots. If run in auto
 mode it will cleanup AMI's and snapshots on any AMI Tagged with autocleanup that
-is older than supplied days old.
+is older than supplied days old. Auto mode also deletes any standalone EBS snapshot
+Tagged with autocleanup, such as those created by awsgo-snapshot-instance -e.
+
+The age of an AMI is taken from its CreationDate and the age of a snapshot from its
+start time. An AMI or snapshot with an expires-at Tag (RFC3339 time or YYYY-MM-DD)
+expires at that time instead. AMI's with dates that can not be parsed are reported
+and skipped.
+
+Sweep mode finds snapshots that were created for an AMI that no longer exists and
+unattached EBS volumes older than the -volume-days threshold and deletes them.
+Snapshots still used by another AMI, such as one brought back with -restore or
+registered by hand, are left alone. It can
+be combined with -n to only report what would be deleted. The snapshots and volumes
+found are listed and confirmation is asked for before they are deleted unless -y is
+given, so use -y when sweeping from cron. They count towards -max-delete-standalone.
+
+With -soft snapshots and volumes are not deleted. This is a reduced version of
+Recycle Bin and archive tier support. The Recycle Bin, the snapshot archive tier and
+AMI deregistration protection are not in the AWS SDK these tools are built with, so
+-soft is a tag based soft delete instead. Removed snapshots and volumes are kept at
+their full storage cost until they are purged and deregistration protection is not
+checked. AMI's are deregistered and their snapshots are tagged autocleanup-deleted
+along with the details needed to register the AMI again, SR-IOV support and the
+volume type, size, IOPS, encryption and delete on termination setting of each device.
+ENA support and boot mode are not in the SDK either, so a restored AMI that needs
+them has to have them set again before it is launched. Standalone snapshots and
+swept volumes are only tagged. In auto mode removed snapshots and volumes are deleted
+for good once they have been removed for longer than the -g grace days. -restore
+lists the removed backups and -restore -i <ami-id|snapshot-id|volume-id> brings one
+back.
+
+In manual mode any number of AMI's can be cleaned up. They can be given as a comma
+separated list to -i, as extra command line arguments or read from stdin using -i -.
+AMI's can also be selected with -name (wildcards allowed), -tag key=value[,key=value],
+-owner and an age range using -older and -newer days.
+
+In manual mode the AMI, its snapshots and tags are displayed and confirmation is
+asked for before anything is deleted. Use -y to skip the question. With -max-delete
+the whole run is aborted without deleting anything if more than this number of AMI's
+would be removed, protecting against a bad clock or tagging mistake. The snapshots of
+those AMI's do not count. -max-delete-standalone does the same for everything else
+that would be removed, the expired standalone snapshots, the purged snapshots and
+volumes and the swept snapshots and volumes.
+
+The cleanup is carried out by a pool of -c workers with separate rate limits for
+deregistering images and deleting snapshots and volumes. On Ctrl-C no new work is
+started, snapshots still waiting to be released by AWS are given up on and listed as
+failed so -sweep can delete them later, work in progress is finished and the results
+so far are reported. A second Ctrl-C stops the program straight away. The result of
+every AMI, snapshot and volume, succeeded or failed, is listed and the program exits
+with a non-zero status if any of them failed.
+
+AMI's that are still referenced by an EC2 instance or an auto scaling launch
+configuration are never deregistered. Launch templates are NOT checked as they are
+not in the AWS SDK these tools are built with, so an AMI used only by a launch
+template can be deregistered and break scaling out the groups that use it. Tag such
+AMI's do-not-delete, as any AMI or snapshot Tagged with do-not-delete is always kept.
+Skipped AMI's are listed with the reason.
+
+With -k the newest N backups of each instance are always kept even when they are
+older than the auto cleanup days. AMI's are grouped by the autobkup-instance Tag or
+the instance in the AMI description and standalone snapshots by their volume.
 
 Command line options -
--i ami-id to be removed
+-i ami-id to be removed. A comma separated list or - to read ami-ids from stdin
+-name Select AMI's with a name matching the pattern
+-tag Select AMI's with the tags key=value[,key=value]
+-owner Owner of the AMI's to select with -name and -tag. Default self
+-older <days> Select AMI's older than this number of days
+-newer <days> Select AMI's newer than this number of days
 -v verbose mode
 -a <days> autodelete mode enabled. Delete images older that this days.
+-r Role ARN to assume so cleanup runs against another account such as the backup account
+-n Dry run. Display the AMI's and snapshots that would be deleted, their age, source
+   instance and size and the total storage that would be reclaimed, then exit
+-j Display the deletion plan as JSON and exit without deleting anything. Implies -n
+-y Do not ask for confirmation in manual or sweep mode
+-c <count> Number of AMI's, snapshots and volumes to cleanup at once. Default 3
+-deregister-rate <n> Maximum DeregisterImage requests per second. Default 3
+-delete-rate <n> Maximum snapshot and volume delete requests per second. Default 5
+-max-delete <count> Abort if more than this number of AMI's would be removed
+-max-delete-standalone <count> Abort if more than this number of standalone snapshots and volumes would be removed
+-k <count> In auto mode always keep the newest count backups of each instance
+-sweep Delete orphaned AMI snapshots and old unattached volumes
+-soft Tag snapshots and volumes as removed and keep them, at full storage cost, instead of deleting them
+-g <days> Days a removed snapshot or volume is kept before it is deleted for good. Default 7
+-restore List removed backups or with -i restore the AMI, snapshot or volume
+-volume-days <days> Age an unattached volume must reach before sweep deletes it. Default 30
 
 */
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/autoscaling"
 	"github.com/awslabs/aws-sdk-go/service/ec2"
+	"github.com/awslabs/aws-sdk-go/service/sts"
 
 	"github.com/gombadi/go-rate"
 )
@@ -29,7 +121,15 @@ import (
 // cmdline flag if we want verbose output
 var verbose bool
 
-func cleanupAMI(svc *ec2.EC2, cleanupImage ec2.Image) {
+// cmdline flag if snapshots and volumes are tagged as removed and kept instead of deleted
+var softMode bool
+
+// rate limits for the AWS requests that deregister images and delete or tag snapshots and volumes
+var deregisterLimit, deleteLimit *rate.RateLimiter
+
+// cleanupAMI deregisters the image and deletes its snapshots. It returns the ids of
+// any snapshots that could not be deleted
+func cleanupAMI(ctx context.Context, svc *ec2.EC2, cleanupImage ec2.Image) (failed []string, err error) {
 	if verbose {
 		fmt.Printf("Info - Deregistering AMI: %s\n", *cleanupImage.ImageID)
 	}
@@ -38,7 +138,8 @@ func cleanupAMI(svc *ec2.EC2, cleanupImage ec2.Image) {
 		ImageID: cleanupImage.ImageID, // Required
 	}
 
-	_, err := svc.DeregisterImage(ec2dii)
+	deregisterLimit.Wait()
+	_, err = svc.DeregisterImage(ec2dii)
 
 	if err != nil {
 		fmt.Printf("\nNon fatal error deregistering image %s...\n%v\n\n", *cleanupImage.ImageID, err)
@@ -46,146 +147,1471 @@ func cleanupAMI(svc *ec2.EC2, cleanupImage ec2.Image) {
 	}
 
 	if verbose {
-		fmt.Printf("Image has been deregistered and now waiting 12 seconds for AWS to release the snapshots from the AMI\n")
+		fmt.Printf("Image has been deregistered. Deleting the snapshots once AWS releases them from the AMI\n")
 	}
 
 	// after the image is deregistered then you can delete the snapshots it used
-	time.Sleep(12 * time.Second)
+	for _, bdm := range cleanupImage.BlockDeviceMappings {
+		// instance store mappings have no snapshot
+		if bdm.EBS == nil || bdm.EBS.SnapshotID == nil || len(*bdm.EBS.SnapshotID) == 0 {
+			continue
+		}
 
-	for blockDM := range cleanupImage.BlockDeviceMappings {
-		if len(*cleanupImage.BlockDeviceMappings[blockDM].EBS.SnapshotID) > 0 {
-			if verbose {
-				fmt.Printf("Info - Deleting associated snapshot: %s from ami: %s\n",
-					*cleanupImage.BlockDeviceMappings[blockDM].EBS.SnapshotID,
-					*cleanupImage.ImageID)
-			}
+		if verbose {
+			fmt.Printf("Info - Deleting associated snapshot: %s from ami: %s\n", *bdm.EBS.SnapshotID, *cleanupImage.ImageID)
+		}
+
+		var snapErr error
+		if softMode {
+			snapErr = softDelete(svc, *bdm.EBS.SnapshotID, softDeleteTags(&cleanupImage, bdm))
+		} else {
+			snapErr = deleteSnapshot(ctx, svc, *bdm.EBS.SnapshotID)
+		}
+		if snapErr != nil {
+			fmt.Printf("\nError deleting the snapshots %s.\n%v\n\n", *bdm.EBS.SnapshotID, snapErr)
+			failed = append(failed, *bdm.EBS.SnapshotID)
+		}
+	}
+	if verbose && len(failed) == 0 && softMode {
+		fmt.Printf("Snapshots have been marked as removed.\n")
+	} else if verbose && len(failed) == 0 {
+		fmt.Printf("Snapshots have been deleted.\n")
+	}
+	return
+}
 
-			ec2dsi := ec2.DeleteSnapshotInput{SnapshotID: cleanupImage.BlockDeviceMappings[blockDM].EBS.SnapshotID}
+// deleteSnapshot deletes a snapshot. While a deregistered AMI is still being released
+// AWS reports the snapshot as in use so retry with backoff until it can be deleted or
+// the context is cancelled
+func deleteSnapshot(ctx context.Context, svc *ec2.EC2, snapshotID string) (err error) {
 
-			_, err := svc.DeleteSnapshot(&ec2dsi)
-			if err != nil {
-				fmt.Printf("\nError deleting the snapshots %s.\n%v\n\n", *cleanupImage.BlockDeviceMappings[blockDM].EBS.SnapshotID, err)
-			}
+	ec2dsi := ec2.DeleteSnapshotInput{SnapshotID: aws.String(snapshotID)}
+	delay := 2 * time.Second
+
+	for attempt := 0; attempt < 8; attempt++ {
+		deleteLimit.Wait()
+		_, err = svc.DeleteSnapshot(&ec2dsi)
+		if awserr := aws.Error(err); awserr == nil || awserr.Code != "InvalidSnapshot.InUse" {
+			return
 		}
+
+		if verbose {
+			fmt.Printf("Info - Snapshot %s still in use. Retrying in %s\n", snapshotID, delay)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cancelled while waiting for snapshot %s to be released: %v", snapshotID, err)
+		case <-time.After(delay):
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+	return
+}
+
+// plannedSnapshot is a snapshot that will be deleted by the cleanup
+type plannedSnapshot struct {
+	SnapshotID string  `json:"snapshot_id"`
+	VolumeID   string  `json:"volume_id,omitempty"`
+	SizeGiB    int64   `json:"size_gib"`
+	AgeDays    float64 `json:"age_days,omitempty"`
+	ImageID    string  `json:"orphaned_from,omitempty"`
+	Purge      bool    `json:"purge,omitempty"`
+}
+
+// plannedVolume is an unattached EBS volume that will be deleted by the sweep
+type plannedVolume struct {
+	VolumeID string  `json:"volume_id"`
+	SizeGiB  int64   `json:"size_gib"`
+	AgeDays  float64 `json:"age_days"`
+	Purge    bool    `json:"purge,omitempty"`
+}
+
+// plannedImage is an AMI that will be deregistered along with its snapshots
+type plannedImage struct {
+	ImageID        string             `json:"image_id"`
+	Name           string             `json:"name"`
+	SourceInstance string             `json:"source_instance,omitempty"`
+	AgeDays        float64            `json:"age_days"`
+	Snapshots      []*plannedSnapshot `json:"snapshots"`
+
+	image *ec2.Image
+}
+
+// skippedImage is an AMI that matched the cleanup rules but is being kept
+type skippedImage struct {
+	ImageID string `json:"image_id"`
+	Name    string `json:"name"`
+	Reason  string `json:"reason"`
+}
+
+// deletionPlan lists every image and snapshot a cleanup run will remove
+type deletionPlan struct {
+	Images    []*plannedImage    `json:"images"`
+	Snapshots []*plannedSnapshot `json:"snapshots"`
+	Volumes   []*plannedVolume   `json:"volumes"`
+	Skipped   []*skippedImage    `json:"skipped"`
+	TotalGiB  int64              `json:"total_gib"`
+}
+
+// skipImage records that an image will be kept and why
+func (p *deletionPlan) skipImage(image *ec2.Image, reason string) {
+
+	si := &skippedImage{ImageID: *image.ImageID, Reason: reason}
+	if image.Name != nil {
+		si.Name = *image.Name
 	}
+	p.Skipped = append(p.Skipped, si)
+
 	if verbose {
-		fmt.Printf("Snapshots have been deleted.\n")
+		fmt.Printf("Info - Not deregistering AMI: %s as %s\n", *image.ImageID, reason)
 	}
 }
 
-func main() {
+// addImage adds an image and its snapshots to the plan
+func (p *deletionPlan) addImage(image *ec2.Image, ageDays float64) {
 
-	// storage for commandline args
-	var autoDays int
-	var amiId string
+	pi := &plannedImage{
+		ImageID:        *image.ImageID,
+		SourceInstance: sourceInstance(image),
+		AgeDays:        ageDays,
+		Snapshots:      []*plannedSnapshot{},
+		image:          image,
+	}
+	if image.Name != nil {
+		pi.Name = *image.Name
+	}
 
-	flag.BoolVar(&verbose, "v", false, "Produce verbose output")
-	flag.IntVar(&autoDays, "a", 0, "In auto cleanup mode cleanup any AMI's older than this number of days")
-	flag.StringVar(&amiId, "i", "", "AMI Id to be deleted")
-	flag.Parse()
+	for _, bdm := range image.BlockDeviceMappings {
+		if bdm.EBS == nil || bdm.EBS.SnapshotID == nil {
+			continue
+		}
+		ps := &plannedSnapshot{SnapshotID: *bdm.EBS.SnapshotID}
+		if bdm.EBS.VolumeSize != nil {
+			ps.SizeGiB = *bdm.EBS.VolumeSize
+		}
+		pi.Snapshots = append(pi.Snapshots, ps)
+		p.TotalGiB += ps.SizeGiB
+	}
+	p.Images = append(p.Images, pi)
+}
 
-	// load the AWS credentials from the environment or from the standard file
+// addSnapshot adds a standalone snapshot to the plan
+func (p *deletionPlan) addSnapshot(snapshot *ec2.Snapshot, ageDays float64) {
 
-	// make sure we are in auto mode or an ami id has been provided
-	if autoDays == 0 && len(amiId) == 0 {
-		fmt.Printf("No ami details provided. Please provide an ami-id to cleanup\nor enable auto cleanup mode and specify a number of days.\n")
-		flag.PrintDefaults()
-		os.Exit(1)
+	ps := &plannedSnapshot{SnapshotID: *snapshot.SnapshotID, AgeDays: ageDays}
+	if snapshot.VolumeID != nil {
+		ps.VolumeID = *snapshot.VolumeID
+	}
+	if snapshot.VolumeSize != nil {
+		ps.SizeGiB = *snapshot.VolumeSize
+	}
+	p.Snapshots = append(p.Snapshots, ps)
+	p.TotalGiB += ps.SizeGiB
+}
+
+// printText writes the plan in a human readable form to stdout
+func (p *deletionPlan) printText() {
+
+	fmt.Printf("AMI's to be deregistered: %d\n", len(p.Images))
+	for _, pi := range p.Images {
+		fmt.Printf("%s\tName: %s\tSource: %s\tAge: %.1f days\n", pi.ImageID, pi.Name, pi.SourceInstance, pi.AgeDays)
+		for _, ps := range pi.Snapshots {
+			fmt.Printf("\tSnapshot: %s\tSize: %d GiB\n", ps.SnapshotID, ps.SizeGiB)
+		}
 	}
 
-	// Create an EC2 service object
-	// config values keys, sercet key & region read from environment
-	svc := ec2.New(&aws.Config{})
+	fmt.Printf("\nStandalone snapshots to be deleted: %d\n", len(p.Snapshots))
+	for _, ps := range p.Snapshots {
+		fmt.Printf("%s\tVolume: %s\tSize: %d GiB\tAge: %.1f days", ps.SnapshotID, ps.VolumeID, ps.SizeGiB, ps.AgeDays)
+		if len(ps.ImageID) > 0 {
+			fmt.Printf("\tOrphaned from: %s", ps.ImageID)
+		}
+		if ps.Purge {
+			fmt.Printf("\tRemoved snapshot past the grace period")
+		}
+		fmt.Printf("\n")
+	}
 
-	ec2Filter := ec2.Filter{}
+	if len(p.Volumes) > 0 {
+		fmt.Printf("\nUnattached volumes to be deleted: %d\n", len(p.Volumes))
+		for _, pv := range p.Volumes {
+			fmt.Printf("%s\tSize: %d GiB\tAge: %.1f days", pv.VolumeID, pv.SizeGiB, pv.AgeDays)
+			if pv.Purge {
+				fmt.Printf("\tRemoved volume past the grace period")
+			}
+			fmt.Printf("\n")
+		}
+	}
 
-	// pointers to objects we use to talk to AWS
-	var imagesResp *ec2.DescribeImagesOutput
-	var err error
+	if len(p.Skipped) > 0 {
+		fmt.Printf("\nAMI's kept: %d\n", len(p.Skipped))
+		for _, si := range p.Skipped {
+			fmt.Printf("%s\tName: %s\tReason: %s\n", si.ImageID, si.Name, si.Reason)
+		}
+	}
 
-	// config for auto mode
-	if autoDays > 0 {
+	fmt.Printf("\nTotal storage to be reclaimed: %d GiB\n", p.TotalGiB)
+}
 
-		// auto mode search for ami's to cleanup
-		ec2Filter.Name = aws.String("tag-key")
-		ec2Filter.Values = []*string{aws.String("autocleanup")}
-		owners := []*string{aws.String("self")}
+// printDetails writes the full details of each image in the plan to stdout
+func (p *deletionPlan) printDetails() {
+
+	for _, pi := range p.Images {
+		fmt.Printf("AMI: %s\n", pi.ImageID)
+		fmt.Printf("\tName: %s\n", pi.Name)
+		if pi.image.Description != nil {
+			fmt.Printf("\tDescription: %s\n", *pi.image.Description)
+		}
+		if pi.image.CreationDate != nil {
+			fmt.Printf("\tCreated: %s (%.1f days ago)\n", *pi.image.CreationDate, pi.AgeDays)
+		}
+		for _, ps := range pi.Snapshots {
+			fmt.Printf("\tSnapshot: %s\tSize: %d GiB\n", ps.SnapshotID, ps.SizeGiB)
+		}
+		for _, tag := range pi.image.Tags {
+			fmt.Printf("\tTag: %s = %s\n", *tag.Key, *tag.Value)
+		}
+	}
+}
+
+// standaloneCount returns the number of snapshots and volumes the plan removes that do
+// not belong to one of its AMI's
+func (p *deletionPlan) standaloneCount() int {
+	return len(p.Snapshots) + len(p.Volumes)
+}
+
+// sweepCount returns the number of orphaned snapshots and volumes the sweep will delete
+func (p *deletionPlan) sweepCount() int {
+
+	count := 0
+	for _, ps := range p.Snapshots {
+		if len(ps.ImageID) > 0 {
+			count++
+		}
+	}
+	for _, pv := range p.Volumes {
+		if !pv.Purge {
+			count++
+		}
+	}
+	return count
+}
+
+// printSweep displays the orphaned snapshots and volumes the sweep will delete
+func (p *deletionPlan) printSweep() {
+
+	for _, ps := range p.Snapshots {
+		if len(ps.ImageID) > 0 {
+			fmt.Printf("Snapshot: %s\tSize: %d GiB\tAge: %.1f days\tOrphaned from: %s\n", ps.SnapshotID, ps.SizeGiB, ps.AgeDays, ps.ImageID)
+		}
+	}
+	for _, pv := range p.Volumes {
+		if !pv.Purge {
+			fmt.Printf("Volume: %s\tSize: %d GiB\tAge: %.1f days\n", pv.VolumeID, pv.SizeGiB, pv.AgeDays)
+		}
+	}
+}
 
-		ec2dii := ec2.DescribeImagesInput{Owners: owners, Filters: []*ec2.Filter{&ec2Filter}}
+// confirm asks the question on stdout and returns true if the answer is yes. When
+// stdin has been used for the ami-ids the answer is read from the terminal
+func confirm(question string, useTerminal bool) bool {
 
-		imagesResp, err = svc.DescribeImages(&ec2dii)
+	in := os.Stdin
+	if useTerminal {
+		tty, err := os.Open("/dev/tty")
 		if err != nil {
-			log.Fatalf("\nError getting the Image details for images.\n%v\n", err)
+			fmt.Printf("Unable to ask for confirmation without a terminal. Use -y to skip the question\n")
+			return false
 		}
-	} else {
-		// single ami manual mode
-		ec2dii := ec2.DescribeImagesInput{ImageIDs: []*string{aws.String(amiId)}}
+		defer tty.Close()
+		in = tty
+	}
+
+	fmt.Printf("%s [y/N]: ", question)
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// printJSON writes the plan as JSON to stdout
+func (p *deletionPlan) printJSON() error {
+
+	out, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", out)
+	return nil
+}
+
+// sourceInstance returns the instance an AMI was created from using the autobkup-instance
+// tag or the description set by awsgo-snapshot-instance
+func sourceInstance(image *ec2.Image) string {
+	for _, tag := range image.Tags {
+		if *tag.Key == "autobkup-instance" {
+			return *tag.Value
+		}
+	}
+	if image.Description == nil || !strings.HasPrefix(*image.Description, "Auto backup of instance ") {
+		return ""
+	}
+	return strings.TrimPrefix(*image.Description, "Auto backup of instance ")
+}
+
+// backupEntry is a backup considered for the minimum number of backups to keep
+type backupEntry struct {
+	group   string
+	id      string
+	ageDays float64
+}
+
+// newestPerGroup returns the ids of the newest keep backups in each group. Backups
+// without a group are not retained
+func newestPerGroup(entries []backupEntry, keep int) map[string]bool {
+
+	newest := make(map[string]bool)
+	if keep <= 0 {
+		return newest
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ageDays < entries[j].ageDays })
+
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		if len(entry.group) == 0 || counts[entry.group] >= keep {
+			continue
+		}
+		counts[entry.group]++
+		newest[entry.id] = true
+	}
+	return newest
+}
+
+// hasTag returns true if the tag key is in the tags
+func hasTag(tags []*ec2.Tag, key string) bool {
+	for _, tag := range tags {
+		if *tag.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// imagesInUse returns the images referenced by instances and launch configurations
+// with a description of what is using each one. Launch templates are not in the SDK
+// so images only used by a launch template are not found
+func imagesInUse(svc *ec2.EC2, svcAs *autoscaling.AutoScaling) (map[string]string, error) {
+
+	inUse := make(map[string]string)
 
-		imagesResp, err = svc.DescribeImages(&ec2dii)
+	// instances in any state other than terminated can still be started again
+	ec2dii := ec2.DescribeInstancesInput{}
+	for {
+		resp, err := svc.DescribeInstances(&ec2dii)
 		if err != nil {
-			log.Fatalf("\nError getting the Image details for image %s...\n%v\n", amiId, err)
+			return nil, fmt.Errorf("DescribeInstances: %v", err)
+		}
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.ImageID == nil || *instance.State.Name == "terminated" {
+					continue
+				}
+				inUse[*instance.ImageID] = "it is used by instance " + *instance.InstanceID
+			}
+		}
+		if resp.NextToken == nil {
+			break
 		}
+		ec2dii.NextToken = resp.NextToken
 	}
 
-	if len(imagesResp.Images) == 0 {
-		if verbose {
-			fmt.Printf("No images found to cleanup. Exiting\n")
+	asdlci := autoscaling.DescribeLaunchConfigurationsInput{}
+	for {
+		resp, err := svcAs.DescribeLaunchConfigurations(&asdlci)
+		if err != nil {
+			return nil, fmt.Errorf("DescribeLaunchConfigurations: %v", err)
 		}
-		os.Exit(0)
+		for _, lc := range resp.LaunchConfigurations {
+			if lc.ImageID != nil {
+				inUse[*lc.ImageID] = "it is used by launch configuration " + *lc.LaunchConfigurationName
+			}
+		}
+		if resp.NextToken == nil {
+			break
+		}
+		asdlci.NextToken = resp.NextToken
 	}
 
-	// use go routines to deregister many at once and
-	// use a waitgroup to sync it all
-	var wg sync.WaitGroup
+	return inUse, nil
+}
+
+// expiresAtTag returns the time from the expires-at tag and whether the tag was found.
+// The value can be an RFC3339 time or a YYYY-MM-DD date
+func expiresAtTag(tags []*ec2.Tag) (time.Time, bool, error) {
+	for _, tag := range tags {
+		if *tag.Key != "expires-at" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, *tag.Value); err == nil {
+			return t, true, nil
+		}
+		t, err := time.Parse("2006-01-02", *tag.Value)
+		if err != nil {
+			return time.Time{}, true, fmt.Errorf("unparseable expires-at tag value %q", *tag.Value)
+		}
+		return t, true, nil
+	}
+	return time.Time{}, false, nil
+}
 
-	// rate limit the AWS requests to max 3 per second
-	rl := rate.New(3, time.Second)
+// ageInDays returns the number of days since created
+func ageInDays(created time.Time) float64 {
+	return time.Since(created).Hours() / 24
+}
 
-	//
-	for image := range imagesResp.Images {
+// backupExpired returns true if a backup created at created has expired. The expires-at
+// tag takes priority otherwise the backup expires after autoDays
+func backupExpired(tags []*ec2.Tag, created time.Time, autoDays int) (bool, error) {
 
-		// The returned Images from AWS should only be the ones with autocleanup but lets check anyway
-		// and only delete if the days have passed
+	expiresAt, found, err := expiresAtTag(tags)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		return time.Now().After(expiresAt), nil
+	}
+	return ageInDays(created) > float64(autoDays), nil
+}
 
-		for tag := range imagesResp.Images[image].Tags {
-			if *imagesResp.Images[image].Tags[tag].Key == "autocleanup" {
-				// check if time is up for this AMI
+// imageCreated returns the time the image was created
+func imageCreated(image *ec2.Image) (time.Time, error) {
+	if image.CreationDate == nil {
+		return time.Time{}, fmt.Errorf("missing CreationDate")
+	}
+	created, err := time.Parse(time.RFC3339, *image.CreationDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unparseable CreationDate %q", *image.CreationDate)
+	}
+	return created, nil
+}
 
-				// extract the time this AMI was created
-				amiCreation, _ := strconv.ParseInt(*imagesResp.Images[image].Tags[tag].Value, 10, 64)
-				amiLifeSpan := time.Now().Unix() - amiCreation
+// planImages adds the images to be cleaned up to the plan. In auto mode only expired
+// images are added otherwise all images are added. Images that are tagged do-not-delete,
+// are in use or have dates that can not be parsed are skipped
+func planImages(plan *deletionPlan, images []*ec2.Image, autoDays, keepCount int, inUse map[string]string) {
 
-				if int64(autoDays*86000) < amiLifeSpan {
+	entries := []backupEntry{}
+	for _, image := range images {
+		if created, err := imageCreated(image); err == nil {
+			entries = append(entries, backupEntry{group: sourceInstance(image), id: *image.ImageID, ageDays: ageInDays(created)})
+		}
+	}
+	newest := newestPerGroup(entries, keepCount)
 
-					anImage := imagesResp.Images[image]
+	for _, image := range images {
 
-					rl.Wait()
+		// the do-not-delete tag always wins
+		if hasTag(image.Tags, "do-not-delete") {
+			plan.skipImage(image, "it is tagged do-not-delete")
+			continue
+		}
 
-					// Increment the WaitGroup counter.
-					wg.Add(1)
+		if reason, ok := inUse[*image.ImageID]; ok {
+			plan.skipImage(image, reason)
+			continue
+		}
 
-					// Launch a goroutine to cleanup the AMI.
-					go func(svc *ec2.EC2, anImage ec2.Image) {
-						// Decrement the counter when the goroutine completes.
-						defer wg.Done()
-						// Fetch the URL.
-						cleanupAMI(svc, anImage)
-					}(svc, *anImage)
+		created, err := imageCreated(image)
+		if err != nil {
+			log.Printf("Skipping AMI %s: %v\n", *image.ImageID, err)
+			plan.skipImage(image, err.Error())
+			continue
+		}
+		ageDays := ageInDays(created)
 
-					// deregister the AMI and delete associated snapshots
-					//cleanupAMI(e, imagesResp.Images[image])
-					//fmt.Printf("\nWould have cleaned up AMI: %s\n\n", imagesResp.Images[image].Id)
-				} else {
-					if verbose {
-						fmt.Printf("Info - Not deregistering AMI: %s as expire time not reached\n", *imagesResp.Images[image].ImageID)
-					}
-				}
+		if autoDays == 0 {
+			plan.addImage(image, ageDays)
+			continue
+		}
+
+		// The returned Images from AWS should only be the ones with autocleanup or expires-at
+		// but lets check anyway and only delete if the days have passed
+		if !hasTag(image.Tags, "autocleanup") && !hasTag(image.Tags, "expires-at") {
+			continue
+		}
+
+		expired, err := backupExpired(image.Tags, created, autoDays)
+		if err != nil {
+			log.Printf("Skipping AMI %s: %v\n", *image.ImageID, err)
+			plan.skipImage(image, err.Error())
+			continue
+		}
+
+		if !expired {
+			if verbose {
+				fmt.Printf("Info - Not deregistering AMI: %s as expire time not reached\n", *image.ImageID)
+			}
+			continue
+		}
+
+		if newest[*image.ImageID] {
+			plan.skipImage(image, fmt.Sprintf("it is one of the newest %d backups of instance %s", keepCount, sourceInstance(image)))
+			continue
+		}
+
+		plan.addImage(image, ageDays)
+	}
+}
+
+// planSnapshots adds expired standalone snapshots tagged with autocleanup or expires-at
+// to the plan. Snapshots that belong to an AMI are left for cleanupAMI
+func planSnapshots(svc *ec2.EC2, plan *deletionPlan, autoDays, keepCount int) {
+
+	ec2dsi := ec2.DescribeSnapshotsInput{
+		OwnerIDs: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{&ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String("autocleanup"), aws.String("expires-at")}}}}
+
+	snapshotsResp, err := svc.DescribeSnapshots(&ec2dsi)
+	if err != nil {
+		log.Fatalf("\nError getting the Snapshot details for snapshots.\n%v\n", err)
+	}
+
+	standalone := []*ec2.Snapshot{}
+	entries := []backupEntry{}
+
+	for _, snapshot := range snapshotsResp.Snapshots {
+
+		// snapshots created for an AMI are removed when the AMI is cleaned up
+		if snapshot.Description != nil &&
+			(strings.HasPrefix(*snapshot.Description, "Created by CreateImage") ||
+				strings.HasPrefix(*snapshot.Description, "Copied for DestinationAmi")) {
+			continue
+		}
+		// removed snapshots are only deleted once the grace period has passed
+		if snapshot.StartTime == nil || hasTag(snapshot.Tags, "autocleanup-deleted") {
+			continue
+		}
+		standalone = append(standalone, snapshot)
+
+		if snapshot.VolumeID != nil {
+			entries = append(entries, backupEntry{group: *snapshot.VolumeID, id: *snapshot.SnapshotID, ageDays: ageInDays(*snapshot.StartTime)})
+		}
+	}
+	newest := newestPerGroup(entries, keepCount)
+
+	for _, snapshot := range standalone {
+
+		if hasTag(snapshot.Tags, "do-not-delete") {
+			if verbose {
+				fmt.Printf("Info - Not deleting snapshot: %s as it is tagged do-not-delete\n", *snapshot.SnapshotID)
+			}
+			continue
+		}
+
+		expired, err := backupExpired(snapshot.Tags, *snapshot.StartTime, autoDays)
+		if err != nil {
+			log.Printf("Skipping snapshot %s: %v\n", *snapshot.SnapshotID, err)
+			continue
+		}
+
+		if !expired {
+			if verbose {
+				fmt.Printf("Info - Not deleting snapshot: %s as expire time not reached\n", *snapshot.SnapshotID)
+			}
+			continue
+		}
+
+		if newest[*snapshot.SnapshotID] {
+			if verbose {
+				fmt.Printf("Info - Not deleting snapshot: %s as it is one of the newest %d backups of volume %s\n",
+					*snapshot.SnapshotID, keepCount, *snapshot.VolumeID)
+			}
+			continue
+		}
+
+		plan.addSnapshot(snapshot, ageInDays(*snapshot.StartTime))
+	}
+}
+
+// cleanupSnapshot deletes a standalone snapshot. In soft mode the snapshot is marked as
+// removed unless it is being purged
+func cleanupSnapshot(ctx context.Context, svc *ec2.EC2, snapshotID string, purge bool) error {
+
+	if verbose {
+		fmt.Printf("Info - Deleting snapshot: %s\n", snapshotID)
+	}
+
+	var err error
+	if softMode && !purge {
+		err = softDelete(svc, snapshotID, softDeleteTags(nil, nil))
+	} else {
+		err = deleteSnapshot(ctx, svc, snapshotID)
+	}
+	if err != nil {
+		fmt.Printf("\nError deleting the snapshot %s.\n%v\n\n", snapshotID, err)
+	}
+	return err
+}
+
+// orphanSnapshotRe matches the descriptions AWS gives snapshots created for an AMI
+var orphanSnapshotRe = regexp.MustCompile(`^(?:Created by CreateImage\(i-[0-9a-f]+\) for|Copied for DestinationAmi) (ami-[0-9a-f]+)`)
+
+// planSweep adds snapshots created for AMI's that no longer exist and unattached EBS
+// volumes older than volumeDays to the plan. A snapshot still used by an existing AMI,
+// such as one restored with -restore or registered by hand, is never swept
+func planSweep(svc *ec2.EC2, plan *deletionPlan, volumeDays int) {
+
+	imagesResp, err := svc.DescribeImages(&ec2.DescribeImagesInput{Owners: []*string{aws.String("self")}})
+	if err != nil {
+		log.Fatalf("\nError getting the Image details for images.\n%v\n", err)
+	}
+
+	images := make(map[string]bool)
+	imageSnapshots := make(map[string]bool)
+	for _, image := range imagesResp.Images {
+		images[*image.ImageID] = true
+		for _, bdm := range image.BlockDeviceMappings {
+			if bdm.EBS != nil && bdm.EBS.SnapshotID != nil {
+				imageSnapshots[*bdm.EBS.SnapshotID] = true
 			}
 		}
 	}
 
-	// Wait for all Amazon requests to complete.
-	wg.Wait()
+	snapshotsResp, err := svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{OwnerIDs: []*string{aws.String("self")}})
+	if err != nil {
+		log.Fatalf("\nError getting the Snapshot details for snapshots.\n%v\n", err)
+	}
+
+	for _, snapshot := range snapshotsResp.Snapshots {
+		if snapshot.Description == nil || snapshot.StartTime == nil {
+			continue
+		}
+
+		match := orphanSnapshotRe.FindStringSubmatch(*snapshot.Description)
+		if match == nil || images[match[1]] || imageSnapshots[*snapshot.SnapshotID] || hasTag(snapshot.Tags, "autocleanup-deleted") {
+			continue
+		}
+
+		if hasTag(snapshot.Tags, "do-not-delete") {
+			if verbose {
+				fmt.Printf("Info - Not deleting orphaned snapshot: %s as it is tagged do-not-delete\n", *snapshot.SnapshotID)
+			}
+			continue
+		}
+
+		plan.addSnapshot(snapshot, ageInDays(*snapshot.StartTime))
+		plan.Snapshots[len(plan.Snapshots)-1].ImageID = match[1]
+	}
+
+	ec2dvi := ec2.DescribeVolumesInput{Filters: []*ec2.Filter{&ec2.Filter{
+		Name:   aws.String("status"),
+		Values: []*string{aws.String("available")}}}}
+
+	volumesResp, err := svc.DescribeVolumes(&ec2dvi)
+	if err != nil {
+		log.Fatalf("\nError getting the Volume details for volumes.\n%v\n", err)
+	}
+
+	for _, volume := range volumesResp.Volumes {
+		// removed volumes are only deleted once the grace period has passed
+		if volume.CreateTime == nil || ageInDays(*volume.CreateTime) <= float64(volumeDays) || hasTag(volume.Tags, "autocleanup-deleted") {
+			continue
+		}
+
+		if hasTag(volume.Tags, "do-not-delete") {
+			if verbose {
+				fmt.Printf("Info - Not deleting volume: %s as it is tagged do-not-delete\n", *volume.VolumeID)
+			}
+			continue
+		}
+
+		pv := &plannedVolume{VolumeID: *volume.VolumeID, AgeDays: ageInDays(*volume.CreateTime)}
+		if volume.Size != nil {
+			pv.SizeGiB = *volume.Size
+		}
+		plan.Volumes = append(plan.Volumes, pv)
+		plan.TotalGiB += pv.SizeGiB
+	}
+}
+
+// cleanupVolume deletes an unattached EBS volume. In soft mode the volume is marked as
+// removed unless it is being purged
+func cleanupVolume(svc *ec2.EC2, volumeID string, purge bool) error {
+
+	if verbose {
+		fmt.Printf("Info - Deleting volume: %s\n", volumeID)
+	}
+
+	var err error
+	if softMode && !purge {
+		err = softDelete(svc, volumeID, softDeleteTags(nil, nil))
+	} else {
+		deleteLimit.Wait()
+		_, err = svc.DeleteVolume(&ec2.DeleteVolumeInput{VolumeID: aws.String(volumeID)})
+	}
+	if err != nil {
+		fmt.Printf("\nError deleting the volume %s.\n%v\n\n", volumeID, err)
+	}
+	return err
+}
+
+// softDeleteKeys are the tags added to a snapshot or volume when it is soft deleted
+var softDeleteKeys = []string{"autocleanup-deleted", "autocleanup-ami", "autocleanup-ami-name",
+	"autocleanup-ami-arch", "autocleanup-ami-root", "autocleanup-ami-virt", "autocleanup-ami-sriov",
+	"autocleanup-device", "autocleanup-volume-type", "autocleanup-volume-size",
+	"autocleanup-volume-iops", "autocleanup-volume-encrypted", "autocleanup-delete-on-termination"}
+
+// softDeleteTags returns the tags that mark a snapshot or volume as removed. For snapshots
+// from an AMI the details needed to register the image again are kept in the tags as well
+func softDeleteTags(image *ec2.Image, bdm *ec2.BlockDeviceMapping) []*ec2.Tag {
+
+	tags := []*ec2.Tag{&ec2.Tag{Key: aws.String("autocleanup-deleted"), Value: aws.String(time.Now().UTC().Format(time.RFC3339))}}
+	if image == nil {
+		return tags
+	}
+
+	boolString := func(b *bool) *string {
+		if b == nil {
+			return nil
+		}
+		return aws.String(strconv.FormatBool(*b))
+	}
+	int64String := func(i *int64) *string {
+		if i == nil {
+			return nil
+		}
+		return aws.String(strconv.FormatInt(*i, 10))
+	}
+
+	details := map[string]*string{
+		"autocleanup-ami":       image.ImageID,
+		"autocleanup-ami-name":  image.Name,
+		"autocleanup-ami-arch":  image.Architecture,
+		"autocleanup-ami-root":  image.RootDeviceName,
+		"autocleanup-ami-virt":  image.VirtualizationType,
+		"autocleanup-ami-sriov": image.SRIOVNetSupport,
+		"autocleanup-device":    bdm.DeviceName,
+	}
+	if bdm.EBS != nil {
+		details["autocleanup-volume-type"] = bdm.EBS.VolumeType
+		details["autocleanup-volume-size"] = int64String(bdm.EBS.VolumeSize)
+		details["autocleanup-volume-iops"] = int64String(bdm.EBS.IOPS)
+		details["autocleanup-volume-encrypted"] = boolString(bdm.EBS.Encrypted)
+		details["autocleanup-delete-on-termination"] = boolString(bdm.EBS.DeleteOnTermination)
+	}
+	for key, value := range details {
+		if value != nil && len(*value) > 0 {
+			tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: value})
+		}
+	}
+	return tags
+}
+
+// optionalTag returns the value of the tag key or nil if the snapshot does not have it
+func optionalTag(tags []*ec2.Tag, key string) *string {
+	if value := tagValue(tags, key); len(value) > 0 {
+		return aws.String(value)
+	}
+	return nil
+}
+
+// restoredDevice builds the block device mapping of a removed snapshot from its tags.
+// Snapshots removed before the volume settings were saved are restored with
+// DeleteOnTermination set as they were before
+func restoredDevice(snapshot *ec2.Snapshot) *ec2.BlockDeviceMapping {
+
+	tags := snapshot.Tags
+	ebs := &ec2.EBSBlockDevice{
+		SnapshotID:          snapshot.SnapshotID,
+		VolumeType:          optionalTag(tags, "autocleanup-volume-type"),
+		DeleteOnTermination: aws.Boolean(tagValue(tags, "autocleanup-delete-on-termination") != "false"),
+	}
+	if size, err := strconv.ParseInt(tagValue(tags, "autocleanup-volume-size"), 10, 64); err == nil {
+		ebs.VolumeSize = aws.Long(size)
+	}
+	// IOPS can only be given for the volume types that take it
+	if iops, err := strconv.ParseInt(tagValue(tags, "autocleanup-volume-iops"), 10, 64); err == nil {
+		switch tagValue(tags, "autocleanup-volume-type") {
+		case "io1", "io2", "gp3":
+			ebs.IOPS = aws.Long(iops)
+		}
+	}
+	if tagValue(tags, "autocleanup-volume-encrypted") == "true" {
+		ebs.Encrypted = aws.Boolean(true)
+	}
+
+	return &ec2.BlockDeviceMapping{
+		DeviceName: aws.String(tagValue(tags, "autocleanup-device")),
+		EBS:        ebs,
+	}
+}
+
+// softDelete marks the snapshot or volume as removed so it can be restored until it is purged
+func softDelete(svc *ec2.EC2, id string, tags []*ec2.Tag) error {
+	deleteLimit.Wait()
+	_, err := svc.CreateTags(&ec2.CreateTagsInput{Resources: []*string{aws.String(id)}, Tags: tags})
+	return err
+}
+
+// tagValue returns the value of the tag key or an empty string
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if *tag.Key == key {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+// softDeleted returns the soft deleted snapshots
+func softDeleted(svc *ec2.EC2) []*ec2.Snapshot {
+
+	ec2dsi := ec2.DescribeSnapshotsInput{
+		OwnerIDs: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{&ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String("autocleanup-deleted")}}}}
+
+	snapshotsResp, err := svc.DescribeSnapshots(&ec2dsi)
+	if err != nil {
+		log.Fatalf("\nError getting the Snapshot details for removed snapshots.\n%v\n", err)
+	}
+	return snapshotsResp.Snapshots
+}
+
+// removedVolumes returns the soft deleted volumes that are still unattached
+func removedVolumes(svc *ec2.EC2) []*ec2.Volume {
+
+	ec2dvi := ec2.DescribeVolumesInput{Filters: []*ec2.Filter{
+		&ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String("autocleanup-deleted")}},
+		&ec2.Filter{
+			Name:   aws.String("status"),
+			Values: []*string{aws.String("available")}}}}
+
+	volumesResp, err := svc.DescribeVolumes(&ec2dvi)
+	if err != nil {
+		log.Fatalf("\nError getting the Volume details for removed volumes.\n%v\n", err)
+	}
+	return volumesResp.Volumes
+}
+
+// pastGrace returns true if the resource was soft deleted more than graceDays ago
+func pastGrace(id string, tags []*ec2.Tag, graceDays int) bool {
+
+	if hasTag(tags, "do-not-delete") {
+		return false
+	}
+
+	deletedAt, err := time.Parse(time.RFC3339, tagValue(tags, "autocleanup-deleted"))
+	if err != nil {
+		log.Printf("Skipping removed %s: unparseable autocleanup-deleted tag\n", id)
+		return false
+	}
+	return ageInDays(deletedAt) > float64(graceDays)
+}
+
+// planPurge adds soft deleted snapshots and volumes that were removed more than
+// graceDays ago to the plan so they are deleted for good
+func planPurge(svc *ec2.EC2, plan *deletionPlan, graceDays int) {
+
+	for _, snapshot := range softDeleted(svc) {
+		if !pastGrace(*snapshot.SnapshotID, snapshot.Tags, graceDays) {
+			continue
+		}
+		plan.addSnapshot(snapshot, ageInDays(*snapshot.StartTime))
+		plan.Snapshots[len(plan.Snapshots)-1].Purge = true
+	}
+
+	for _, volume := range removedVolumes(svc) {
+		if volume.CreateTime == nil || !pastGrace(*volume.VolumeID, volume.Tags, graceDays) {
+			continue
+		}
+		pv := &plannedVolume{VolumeID: *volume.VolumeID, AgeDays: ageInDays(*volume.CreateTime), Purge: true}
+		if volume.Size != nil {
+			pv.SizeGiB = *volume.Size
+		}
+		plan.Volumes = append(plan.Volumes, pv)
+		plan.TotalGiB += pv.SizeGiB
+	}
+}
+
+// listRemoved displays the soft deleted backups that can be restored
+func listRemoved(svc *ec2.EC2) {
+
+	// group the snapshots by the AMI they belonged to. Standalone snapshots are their own group
+	groups := make(map[string][]*ec2.Snapshot)
+	order := []string{}
+	for _, snapshot := range softDeleted(svc) {
+		id := tagValue(snapshot.Tags, "autocleanup-ami")
+		if len(id) == 0 {
+			id = *snapshot.SnapshotID
+		}
+		if _, ok := groups[id]; !ok {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], snapshot)
+	}
+
+	volumes := removedVolumes(svc)
+
+	if len(order) == 0 && len(volumes) == 0 {
+		fmt.Printf("No removed backups found\n")
+		return
+	}
+
+	fmt.Printf("Removed backups that can be restored with -restore -i <id>:\n")
+	for _, id := range order {
+		first := groups[id][0]
+		fmt.Printf("%s\tName: %s\tRemoved: %s\n", id, tagValue(first.Tags, "autocleanup-ami-name"), tagValue(first.Tags, "autocleanup-deleted"))
+		for _, snapshot := range groups[id] {
+			fmt.Printf("\tSnapshot: %s\tDevice: %s\tSize: %d GiB\n", *snapshot.SnapshotID, tagValue(snapshot.Tags, "autocleanup-device"), *snapshot.VolumeSize)
+		}
+	}
+	for _, volume := range volumes {
+		fmt.Printf("%s\tVolume\tRemoved: %s\tSize: %d GiB\n", *volume.VolumeID, tagValue(volume.Tags, "autocleanup-deleted"), *volume.Size)
+	}
+}
+
+// restoreRemoved brings back a soft deleted backup. An AMI is registered again from its
+// snapshots and a standalone snapshot or volume is tagged do-not-delete so it is not
+// expired or swept again
+func restoreRemoved(svc *ec2.EC2, id string) error {
+
+	snapshots := []*ec2.Snapshot{}
+	resources := []*string{}
+	if strings.HasPrefix(id, "vol-") {
+		for _, volume := range removedVolumes(svc) {
+			if *volume.VolumeID == id {
+				resources = append(resources, volume.VolumeID)
+			}
+		}
+	} else {
+		for _, snapshot := range softDeleted(svc) {
+			if tagValue(snapshot.Tags, "autocleanup-ami") == id || *snapshot.SnapshotID == id {
+				snapshots = append(snapshots, snapshot)
+				resources = append(resources, snapshot.SnapshotID)
+			}
+		}
+	}
+	if len(resources) == 0 {
+		return fmt.Errorf("no removed backup found for %s", id)
+	}
+
+	if strings.HasPrefix(id, "ami-") {
+		first := snapshots[0].Tags
+		ec2rii := ec2.RegisterImageInput{
+			Name:               aws.String(tagValue(first, "autocleanup-ami-name")),
+			Description:        aws.String("Restored from removed backup " + id),
+			Architecture:       aws.String(tagValue(first, "autocleanup-ami-arch")),
+			RootDeviceName:     aws.String(tagValue(first, "autocleanup-ami-root")),
+			VirtualizationType: aws.String(tagValue(first, "autocleanup-ami-virt")),
+			SRIOVNetSupport:    optionalTag(first, "autocleanup-ami-sriov"),
+		}
+		for _, snapshot := range snapshots {
+			ec2rii.BlockDeviceMappings = append(ec2rii.BlockDeviceMappings, restoredDevice(snapshot))
+		}
+
+		resp, err := svc.RegisterImage(&ec2rii)
+		if err != nil {
+			return fmt.Errorf("RegisterImage: %v", err)
+		}
+		fmt.Printf("Removed AMI %s has been restored as %s\n", id, *resp.ImageID)
+		fmt.Printf("Set ENA support and the boot mode again if the AMI used them as they could not be saved\n")
+	} else {
+		_, err := svc.CreateTags(&ec2.CreateTagsInput{
+			Resources: resources,
+			Tags:      []*ec2.Tag{&ec2.Tag{Key: aws.String("do-not-delete"), Value: aws.String("restored")}}})
+		if err != nil {
+			return fmt.Errorf("CreateTags: %v", err)
+		}
+		fmt.Printf("Removed backup %s has been restored and tagged do-not-delete\n", id)
+	}
+
+	// the snapshots are no longer removed
+	ec2dti := ec2.DeleteTagsInput{Resources: resources}
+	for _, key := range softDeleteKeys {
+		ec2dti.Tags = append(ec2dti.Tags, &ec2.Tag{Key: aws.String(key)})
+	}
+	if _, err := svc.DeleteTags(&ec2dti); err != nil {
+		return fmt.Errorf("DeleteTags: %v", err)
+	}
+	return nil
+}
+
+// imageSelector holds the filters used to pick images in manual mode
+type imageSelector struct {
+	namePattern string
+	tagFilters  string
+	owner       string
+	olderDays   int
+	newerDays   int
+}
+
+// active returns true if any filter that narrows down the images has been set
+func (sel imageSelector) active() bool {
+	return len(sel.namePattern) > 0 || len(sel.tagFilters) > 0 || sel.olderDays > 0 || sel.newerDays > 0
+}
+
+// describeInput builds the DescribeImages request for the name, tag and owner filters
+func (sel imageSelector) describeInput() (*ec2.DescribeImagesInput, error) {
+
+	ec2dii := &ec2.DescribeImagesInput{Owners: []*string{aws.String(sel.owner)}}
+
+	if len(sel.namePattern) > 0 {
+		ec2dii.Filters = append(ec2dii.Filters, &ec2.Filter{
+			Name:   aws.String("name"),
+			Values: []*string{aws.String(sel.namePattern)}})
+	}
+
+	if len(sel.tagFilters) > 0 {
+		for _, tagFilter := range strings.Split(sel.tagFilters, ",") {
+			kv := strings.SplitN(tagFilter, "=", 2)
+			if len(kv) != 2 || len(kv[0]) == 0 {
+				return nil, fmt.Errorf("tag filter %q is not in the form key=value", tagFilter)
+			}
+			ec2dii.Filters = append(ec2dii.Filters, &ec2.Filter{
+				Name:   aws.String("tag:" + kv[0]),
+				Values: []*string{aws.String(kv[1])}})
+		}
+	}
+	return ec2dii, nil
+}
+
+// matchesAge returns true if the image is within the older and newer age range
+func (sel imageSelector) matchesAge(image *ec2.Image) bool {
+
+	created, err := imageCreated(image)
+	if err != nil {
+		// let planImages report the bad date
+		return true
+	}
+	ageDays := ageInDays(created)
+
+	if sel.olderDays > 0 && ageDays <= float64(sel.olderDays) {
+		return false
+	}
+	if sel.newerDays > 0 && ageDays >= float64(sel.newerDays) {
+		return false
+	}
+	return true
+}
+
+// readImageIds returns the image ids from the -i flag, the command line arguments and,
+// if the -i value is -, stdin. It also returns true if stdin was read
+func readImageIds(amiId string, args []string) (ids []string, fromStdin bool, err error) {
+
+	for _, id := range append(strings.Split(amiId, ","), args...) {
+		id = strings.TrimSpace(id)
+		switch {
+		case id == "-":
+			fromStdin = true
+		case len(id) > 0:
+			ids = append(ids, id)
+		}
+	}
+
+	if fromStdin {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Split(bufio.ScanWords)
+		for scanner.Scan() {
+			ids = append(ids, scanner.Text())
+		}
+		err = scanner.Err()
+	}
+	return
+}
+
+// findImages returns the images selected by auto mode, the image ids or the selector
+func findImages(svc *ec2.EC2, autoDays int, ids []string, sel imageSelector) []*ec2.Image {
+
+	var ec2dii *ec2.DescribeImagesInput
+	var err error
+
+	switch {
+	case autoDays > 0:
+		// auto mode search for ami's to cleanup
+		ec2dii = &ec2.DescribeImagesInput{
+			Owners: []*string{aws.String("self")},
+			Filters: []*ec2.Filter{&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String("autocleanup"), aws.String("expires-at")}}}}
+	case len(ids) > 0:
+		// manual mode with a list of ami's
+		ec2dii = &ec2.DescribeImagesInput{}
+		for _, id := range ids {
+			ec2dii.ImageIDs = append(ec2dii.ImageIDs, aws.String(id))
+		}
+	case sel.active():
+		// manual mode selecting ami's by filters
+		if ec2dii, err = sel.describeInput(); err != nil {
+			log.Fatalf("Invalid image filter: %v\n", err)
+		}
+	default:
+		return nil
+	}
+
+	imagesResp, err := svc.DescribeImages(ec2dii)
+	if err != nil {
+		log.Fatalf("\nError getting the Image details for images.\n%v\n", err)
+	}
+
+	if autoDays > 0 || len(ids) > 0 {
+		return imagesResp.Images
+	}
+
+	images := []*ec2.Image{}
+	for _, image := range imagesResp.Images {
+		if sel.matchesAge(image) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// cleanupJob is one AMI, standalone snapshot or volume to be removed
+type cleanupJob struct {
+	kind  string
+	id    string
+	image *ec2.Image
+	purge bool
+}
+
+// cleanupResult is the outcome of a cleanupJob
+type cleanupResult struct {
+	Kind            string   `json:"kind"`
+	ID              string   `json:"id"`
+	Error           string   `json:"error,omitempty"`
+	FailedSnapshots []string `json:"failed_snapshots,omitempty"`
+}
+
+// failed returns true if the job did not fully complete
+func (r cleanupResult) failed() bool {
+	return len(r.Error) > 0 || len(r.FailedSnapshots) > 0
+}
+
+// cleanupWorker runs jobs until the jobs channel is closed. Once the context is cancelled
+// no new jobs are started. A job that has already started carries on but the snapshots
+// of a deregistered AMI that AWS has not released yet are given up on, so they are
+// reported as failed and left for a later run with -sweep to delete
+func cleanupWorker(ctx context.Context, svc *ec2.EC2, jobs <-chan cleanupJob, results chan<- cleanupResult, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	for job := range jobs {
+
+		result := cleanupResult{Kind: job.kind, ID: job.id}
+
+		if ctx.Err() != nil {
+			result.Error = "cancelled"
+			results <- result
+			continue
+		}
+
+		var err error
+		switch job.kind {
+		case "ami":
+			// deregister the AMI and delete associated snapshots
+			result.FailedSnapshots, err = cleanupAMI(ctx, svc, *job.image)
+		case "snapshot":
+			err = cleanupSnapshot(ctx, svc, job.id, job.purge)
+		case "volume":
+			err = cleanupVolume(svc, job.id, job.purge)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results <- result
+	}
+}
+
+// runCleanup carries out the plan using a pool of concurrency workers and returns the
+// result of every job
+func runCleanup(ctx context.Context, svc *ec2.EC2, plan *deletionPlan, concurrency int) []cleanupResult {
+
+	jobs := make(chan cleanupJob)
+	results := make(chan cleanupResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go cleanupWorker(ctx, svc, jobs, results, &wg)
+	}
+
+	go func() {
+		for _, pi := range plan.Images {
+			jobs <- cleanupJob{kind: "ami", id: pi.ImageID, image: pi.image}
+		}
+		for _, ps := range plan.Snapshots {
+			jobs <- cleanupJob{kind: "snapshot", id: ps.SnapshotID, purge: ps.Purge}
+		}
+		for _, pv := range plan.Volumes {
+			jobs <- cleanupJob{kind: "volume", id: pv.VolumeID, purge: pv.Purge}
+		}
+		close(jobs)
+	}()
+
+	// close results once every worker has finished
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	all := []cleanupResult{}
+	for result := range results {
+		all = append(all, result)
+	}
+	return all
+}
+
+// printResults writes the result of every job and a summary to stdout and returns the
+// number of jobs that failed
+func printResults(results []cleanupResult) (failures int) {
+
+	if len(results) == 0 {
+		return
+	}
+
+	failedSnapshots := []string{}
+
+	for _, result := range results {
+		if !result.failed() {
+			fmt.Printf("OK\t%s\t%s\n", result.Kind, result.ID)
+			continue
+		}
+		failures++
+		fmt.Printf("FAILED\t%s\t%s\t%s\n", result.Kind, result.ID, result.Error)
+		failedSnapshots = append(failedSnapshots, result.FailedSnapshots...)
+		if result.Kind == "snapshot" && result.Error != "cancelled" {
+			failedSnapshots = append(failedSnapshots, result.ID)
+		}
+	}
+
+	if len(failedSnapshots) > 0 {
+		fmt.Printf("\nThe following snapshots could not be deleted:\n")
+		for _, snapshotID := range failedSnapshots {
+			fmt.Printf("%s\n", snapshotID)
+		}
+	}
+
+	fmt.Printf("\nCleanup complete. Succeeded: %d\tFailed: %d\n", len(results)-failures, failures)
+	return
+}
+
+// assumeRoleSvc assumes the role and returns an EC2 service object in the same
+// region that acts as the account owning the role
+func assumeRoleSvc(roleARN, region string) (*ec2.EC2, error) {
+
+	svcSts := sts.New(&aws.Config{})
+
+	resp, err := svcSts.AssumeRole(&sts.AssumeRoleInput{
+		RoleARN:         aws.String(roleARN),
+		RoleSessionName: aws.String("awsgo-ami-cleanup"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ec2.New(&aws.Config{
+		Credentials: aws.Creds(*resp.Credentials.AccessKeyID, *resp.Credentials.SecretAccessKey, *resp.Credentials.SessionToken),
+		Region:      region,
+	}), nil
+}
+
+func main() {
+
+	// storage for commandline args
+	var autoDays, keepCount int
+	var amiId, roleARN string
+	var dryRun, jsonOutput, sweep bool
+	var volumeDays, graceDays int
+	var restore, assumeYes bool
+	var maxDelete, maxStandalone, concurrency, deregisterRate, deleteRate int
+	sel := imageSelector{}
+
+	flag.BoolVar(&verbose, "v", false, "Produce verbose output")
+	flag.IntVar(&autoDays, "a", 0, "In auto cleanup mode cleanup any AMI's older than this number of days")
+	flag.StringVar(&amiId, "i", "", "AMI Id to be deleted")
+	flag.StringVar(&sel.namePattern, "name", "", "Select AMI's with a name matching the pattern")
+	flag.StringVar(&sel.tagFilters, "tag", "", "Select AMI's with the tags key=value[,key=value]")
+	flag.StringVar(&sel.owner, "owner", "self", "Owner of the AMI's to select with -name and -tag")
+	flag.IntVar(&sel.olderDays, "older", 0, "Select AMI's older than this number of days")
+	flag.IntVar(&sel.newerDays, "newer", 0, "Select AMI's newer than this number of days")
+	flag.StringVar(&roleARN, "r", "", "Role ARN to assume and cleanup AMI's in that account")
+	flag.BoolVar(&dryRun, "n", false, "Dry run. Display what would be deleted without deleting anything")
+	flag.BoolVar(&jsonOutput, "j", false, "Display the deletion plan as JSON and exit. Implies -n")
+	flag.BoolVar(&assumeYes, "y", false, "Do not ask for confirmation in manual or sweep mode")
+	flag.IntVar(&concurrency, "c", 3, "Number of AMI's, snapshots and volumes to cleanup at once")
+	flag.IntVar(&deregisterRate, "deregister-rate", 3, "Maximum DeregisterImage requests per second")
+	flag.IntVar(&deleteRate, "delete-rate", 5, "Maximum snapshot and volume delete requests per second")
+	flag.IntVar(&maxDelete, "max-delete", 0, "Abort if more than this number of AMI's would be removed")
+	flag.IntVar(&maxStandalone, "max-delete-standalone", 0, "Abort if more than this number of standalone snapshots and volumes would be removed")
+	flag.IntVar(&keepCount, "k", 0, "In auto mode always keep the newest count backups of each instance")
+	flag.BoolVar(&sweep, "sweep", false, "Delete orphaned AMI snapshots and old unattached volumes")
+	flag.BoolVar(&softMode, "soft", false, "Tag snapshots and volumes as removed and keep them, at full storage cost, instead of deleting them")
+	flag.IntVar(&graceDays, "g", 7, "Days a removed snapshot or volume is kept before it is deleted for good")
+	flag.BoolVar(&restore, "restore", false, "List removed backups or with -i restore the AMI, snapshot or volume")
+	flag.IntVar(&volumeDays, "volume-days", 30, "Age in days an unattached volume must reach before sweep deletes it")
+	flag.Parse()
+
+	// the JSON plan is for a reviewer to approve so the run stops once it is displayed
+	if jsonOutput {
+		dryRun = true
+	}
+
+	if concurrency < 1 || deregisterRate < 1 || deleteRate < 1 {
+		log.Fatalf("Concurrency and rate limits must be at least 1\n")
+	}
+
+	// load the AWS credentials from the environment or from the standard file
+
+	// make sure we are in auto mode or an ami id has been provided
+	if autoDays == 0 && len(amiId) == 0 && flag.NArg() == 0 && !sel.active() && !sweep && !restore {
+		fmt.Printf("No ami details provided. Please provide ami-ids or filters to cleanup\nor enable auto cleanup mode and specify a number of days\nor enable sweep mode.\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// Create an EC2 service object
+	// config values keys, sercet key & region read from environment
+	svc := ec2.New(&aws.Config{})
+
+	// when a role is provided cleanup the images owned by that account instead
+	if len(roleARN) > 0 {
+		roleSvc, err := assumeRoleSvc(roleARN, svc.Config.Region)
+		if err != nil {
+			log.Fatalf("Fatal error: unable to assume role %s - %s\n", roleARN, err)
+		}
+		svc = roleSvc
+	}
+
+	if restore {
+		if len(amiId) == 0 {
+			listRemoved(svc)
+			os.Exit(0)
+		}
+		if err := restoreRemoved(svc, amiId); err != nil {
+			log.Fatalf("Error restoring %s: %v\n", amiId, err)
+		}
+		os.Exit(0)
+	}
+
+	// manual mode ami-ids from the command line and stdin
+	var ids []string
+	var idsFromStdin bool
+	var err error
+	if autoDays == 0 {
+		if ids, idsFromStdin, err = readImageIds(amiId, flag.Args()); err != nil {
+			log.Fatalf("Error reading ami-ids: %v\n", err)
+		}
+	}
+	manual := len(ids) > 0 || (autoDays == 0 && sel.active())
+
+	images := findImages(svc, autoDays, ids, sel)
+
+	if len(images) == 0 && autoDays == 0 && !sweep {
+		if verbose {
+			fmt.Printf("No images found to cleanup. Exiting\n")
+		}
+		os.Exit(0)
+	}
+
+	// work out everything that will be removed before touching anything
+	plan := &deletionPlan{Images: []*plannedImage{}, Snapshots: []*plannedSnapshot{}, Volumes: []*plannedVolume{}, Skipped: []*skippedImage{}}
+
+	inUse := map[string]string{}
+	if len(images) > 0 {
+		svcAs := autoscaling.New(svc.Config)
+		inUse, err = imagesInUse(svc, svcAs)
+		if err != nil {
+			log.Fatalf("\nError checking which images are in use.\n%v\n", err)
+		}
+	}
+
+	planImages(plan, images, autoDays, keepCount, inUse)
+
+	// standalone volume snapshots are expired with the same rules
+	if autoDays > 0 {
+		planSnapshots(svc, plan, autoDays, keepCount)
+		planPurge(svc, plan, graceDays)
+	}
+
+	if sweep {
+		planSweep(svc, plan, volumeDays)
+	}
+
+	if jsonOutput {
+		if err = plan.printJSON(); err != nil {
+			log.Fatalf("Error displaying the deletion plan: %v\n", err)
+		}
+	} else if dryRun || verbose {
+		plan.printText()
+	}
+
+	// protect against a bad clock or tag wiping out every backup
+	if maxDelete > 0 && len(plan.Images) > maxDelete {
+		fmt.Fprintf(os.Stderr, "Aborting. %d AMI's would be removed which is more than the maximum of %d\n", len(plan.Images), maxDelete)
+		os.Exit(1)
+	}
+	if total := plan.standaloneCount(); maxStandalone > 0 && total > maxStandalone {
+		fmt.Fprintf(os.Stderr, "Aborting. %d standalone snapshots and volumes would be removed which is more than the maximum of %d\n", total, maxStandalone)
+		os.Exit(1)
+	}
+
+	if dryRun {
+		os.Exit(0)
+	}
+
+	// in manual mode show what is about to be deleted and check before going ahead
+	if manual && !assumeYes && len(plan.Images) > 0 {
+		plan.printDetails()
+		if !confirm(fmt.Sprintf("Deregister %d AMI's and delete their snapshots?", len(plan.Images)), idsFromStdin) {
+			fmt.Printf("Nothing deleted.\n")
+			os.Exit(0)
+		}
+	}
+
+	// the sweep removes things no backup run created so always check first
+	if sweep && !assumeYes && plan.sweepCount() > 0 {
+		plan.printSweep()
+		if !confirm(fmt.Sprintf("Delete %d orphaned snapshots and unattached volumes?", plan.sweepCount()), idsFromStdin) {
+			fmt.Printf("Nothing deleted.\n")
+			os.Exit(0)
+		}
+	}
+
+	deregisterLimit = rate.New(deregisterRate, time.Second)
+	deleteLimit = rate.New(deleteRate, time.Second)
+
+	// stop starting new work on Ctrl-C and report what was done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		// a second Ctrl-C stops the program straight away
+		signal.Stop(sigs)
+		fmt.Printf("\nInterrupted. Finishing the AMI's in progress and stopping.\n")
+		cancel()
+	}()
+
+	results := runCleanup(ctx, svc, plan, concurrency)
+
+	if failures := printResults(results); failures > 0 {
+		os.Exit(1)
+	}
 
 	if verbose {
 		fmt.Printf("All done.\n")
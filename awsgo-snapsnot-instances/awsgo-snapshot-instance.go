@@ -1,33 +1,91 @@
 /*
 This application will snapshot an amazon instance and also give it
-tags of Key:Date, Value:todays date and key:Name, Value:same as existing
-Name Tag or use instanceId
+tags of Key:autocleanup, Value:creation time, Key:Name, Value:the AMI name and
+Key:autobkup-instance, Value:the instanceId
+
+The AMI name is built from the template given with -n. The template can use
+{{.Name}} (the instance Name Tag or the instanceId if there is none), {{.InstanceID}},
+{{.Date}} (YYYY-MM-DD) and {{.Time}} (HHMMSS). The result is cleaned up to meet
+the AMI naming rules and a -2, -3 etc suffix is added if the name is already in use.
 
 The resulting AMI can be used to recover the instance if needed.
 
 In auto mode it will find all current instances with a Tag name of autobkup
 and create an AMI of them with a Tag of autocleanup
 
+Backups can be shared with a separate backup account so they survive the loss of
+the production account. With -s the new AMI and its snapshots are shared with the
+backup account and with -r a role in the backup account is assumed to copy the AMI
+so the backup account owns an independent copy tagged with autocleanup. The AMI can
+only be shared once it is available, which for the first backup of a large volume
+can take hours, so each AMI is waited on for up to 3 hours, the same as -verify waits
+for snapshots. The role is assumed again for each copy so long runs do not fail when
+the temporary credentials expire.
+
+By default instances are not rebooted so the AMI is crash-consistent. For
+application-consistent backups an instance can be rebooted by tagging it with
+autobkup-reboot:true or by using -b. Commands to freeze filesystems or flush databases
+can be run before CreateImage and after it returns using -pre and -post. Hooks for
+particular instances are defined in a local file given with -hooks, a JSON object of
+hook names each with a pre and post command, e.g.
+{"mysql": {"pre": "/usr/local/bin/mysql-freeze", "post": "/usr/local/bin/mysql-thaw"}}
+An instance tagged autobkup-hook:mysql uses the mysql hook instead of -pre and -post.
+The tag only names a hook, the commands always come from this host. An instance that
+names a hook that is not defined is not backed up and is reported as failed.
+Hooks are run on this host with the INSTANCE_ID environment variable set. Only local
+hooks are supported. Running the commands on the instance itself through SSM needs
+SendCommand, which is not in the AWS SDK these tools are built with, so remote hooks
+are out of scope until the tools move to a newer SDK.
+
+With -e the EBS volumes are snapshotted directly instead of creating an AMI. The
+volumes attached to the instance can be limited to a list of device names with -d.
+In auto mode any volume with a Tag name of autobkup is also snapshotted. The
+snapshots are given the same autocleanup Tag so awsgo-ami-cleanup will expire them.
+The pre and post commands are only run when creating an AMI.
+
+At the end of each run a summary of the instances considered, images and snapshots
+created, tag failures and durations is printed and with -o it is also written as
+JSON. With -verify each new AMI is checked to be available with all of its snapshots
+completed. The program exits with a non-zero status if any backup failed.
+
 Command line options -
 -a <true|false> Auto snapshot mode
+-b Allow instances to be rebooted while the AMI is created
+-d Comma separated list of device names to snapshot in volume mode. Default all EBS volumes
+-e Snapshot EBS volumes instead of creating an AMI
 -i Instance ID to be backed up
+-n Template for the AMI name and Name tag. Default {{.Name}}-{{.InstanceID}}-{{.Date}}
+-hooks File defining the named hooks instances can select with the autobkup-hook tag
+-o File to write the JSON run report to
+-pre Command to run before the AMI is created
+-post Command to run after the AMI has been created
+-s Backup account id to share the new AMI and snapshots with
+-r Role ARN in the backup account to assume and copy the AMI into that account
 -v verbose mode
+-verify Wait for each AMI to be available and its snapshots completed
 
 
 */
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/service/ec2"
+	"github.com/awslabs/aws-sdk-go/service/sts"
 
 	"github.com/gombadi/go-rate"
 )
@@ -35,7 +93,186 @@ import (
 // cmdline flag if we want verbose output
 var verbose bool
 
-func getBkupInstances(svc *ec2.EC2, bkupId string) (bkupInstances []*ec2.CreateImageInput) {
+// backup account id to share new images with
+var shareAccount string
+
+// role in the backup account assumed to copy shared images. Empty if not copying
+var backupRole string
+
+// backupWait is how long to wait for a new image or its snapshots. The first snapshot
+// of a large volume can take hours and an image is only available once they complete
+const backupWait = 3 * time.Hour
+
+// runner used to execute the pre and post image hooks
+var runner hookRunner
+
+// bkupInstance holds the details needed to create an AMI of an instance along with
+// the commands to run either side of creating the image
+type bkupInstance struct {
+	image     ec2.CreateImageInput
+	preHook   string
+	postHook  string
+	hookError string
+}
+
+// imageHook is a pair of commands run either side of creating an image
+type imageHook struct {
+	Pre  string `json:"pre"`
+	Post string `json:"post"`
+}
+
+// loadHooks reads the named hooks from a local JSON file
+func loadHooks(fileName string) (map[string]imageHook, error) {
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make(map[string]imageHook)
+	if err = json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return hooks, nil
+}
+
+// imageNameData holds the values available to the AMI name template
+type imageNameData struct {
+	Name       string
+	InstanceID string
+	Date       string
+	Time       string
+}
+
+// bkupVolume holds the details needed to snapshot an EBS volume
+type bkupVolume struct {
+	snapshot   ec2.CreateSnapshotInput
+	instanceID string
+	device     string
+}
+
+// bkupResult records the outcome of backing up one instance or volume
+type bkupResult struct {
+	InstanceID  string   `json:"instance_id,omitempty"`
+	VolumeID    string   `json:"volume_id,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	ImageID     string   `json:"image_id,omitempty"`
+	SnapshotIDs []string `json:"snapshot_ids,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	TagError    string   `json:"tag_error,omitempty"`
+	BackupError string   `json:"backup_error,omitempty"`
+	Verified    bool     `json:"verified"`
+	VerifyError string   `json:"verify_error,omitempty"`
+	Seconds     float64  `json:"seconds"`
+}
+
+// failed returns true if the backup can not be relied on
+func (r *bkupResult) failed() bool {
+	return len(r.Error) > 0 || len(r.BackupError) > 0 || len(r.VerifyError) > 0
+}
+
+// runReport is the summary of a backup run
+type runReport struct {
+	Started     time.Time     `json:"started"`
+	Finished    time.Time     `json:"finished"`
+	Considered  int           `json:"considered"`
+	Created     int           `json:"created"`
+	TagFailures int           `json:"tag_failures"`
+	Failed      int           `json:"failed"`
+	Results     []*bkupResult `json:"results"`
+
+	mu sync.Mutex
+}
+
+// add records the result of a backup. Safe to call from many goroutines
+func (r *runReport) add(result *bkupResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Results = append(r.Results, result)
+	if len(result.Error) == 0 {
+		r.Created++
+	}
+	if len(result.TagError) > 0 {
+		r.TagFailures++
+	}
+	if result.failed() {
+		r.Failed++
+	}
+}
+
+// printText writes a human readable summary of the run to stdout
+func (r *runReport) printText() {
+
+	fmt.Printf("Backup run started %s finished %s (%s)\n",
+		r.Started.Format(time.RFC3339), r.Finished.Format(time.RFC3339), r.Finished.Sub(r.Started).Round(time.Second))
+	fmt.Printf("Considered: %d\tCreated: %d\tTag failures: %d\tFailed: %d\n\n", r.Considered, r.Created, r.TagFailures, r.Failed)
+
+	for _, result := range r.Results {
+		status := "OK"
+		if result.failed() {
+			status = "FAILED"
+		}
+
+		source := result.InstanceID
+		if len(result.VolumeID) > 0 {
+			source = result.VolumeID
+		}
+
+		created := result.ImageID
+		if len(created) == 0 {
+			created = strings.Join(result.SnapshotIDs, ",")
+		}
+
+		fmt.Printf("%s\t%s\t%s\t%s\t%.0fs\n", status, source, result.Name, created, result.Seconds)
+
+		for _, msg := range []string{result.Error, result.TagError, result.BackupError, result.VerifyError} {
+			if len(msg) > 0 {
+				fmt.Printf("\t%s\n", msg)
+			}
+		}
+	}
+}
+
+// writeJSON writes the run report as JSON to the file
+func (r *runReport) writeJSON(fileName string) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, out, 0644)
+}
+
+// hookRunner runs a pre or post image command for an instance
+type hookRunner interface {
+	Run(instanceID, command string) error
+}
+
+// localRunner runs hook commands on this host
+type localRunner struct{}
+
+func (localRunner) Run(instanceID, command string) error {
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "INSTANCE_ID="+instanceID)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	if verbose && len(out) > 0 {
+		fmt.Printf("Hook output for instance %s:\n%s", instanceID, out)
+	}
+	return nil
+}
+
+// describeBkupInstances returns the reservations holding the instance to be backed up
+// or all instances with an autobkup tag if no instance id is provided
+func describeBkupInstances(svc *ec2.EC2, bkupId string) []*ec2.Reservation {
 
 	instanceSlice := []*string{}
 	ec2Filter := ec2.Filter{}
@@ -61,50 +298,310 @@ func getBkupInstances(svc *ec2.EC2, bkupId string) (bkupInstances []*ec2.CreateI
 		// A non-service error occurred.
 		log.Fatalf("Fatal error: DescribeInstances - %s\n", err)
 	}
+	return resp.Reservations
+}
+
+func getBkupInstances(svc *ec2.EC2, bkupId string, reboot bool, preHook, postHook string, hooks map[string]imageHook, nameTmpl *template.Template) (bkupInstances []*bkupInstance) {
+
+	reservations := describeBkupInstances(svc, bkupId)
+
+	// names handed out during this run so two instances with the same Name do not collide
+	usedNames := make(map[string]bool)
+	now := time.Now()
 
 	// for any instance found extract tag name and instanceid
-	for reservation := range resp.Reservations {
-		for instance := range resp.Reservations[reservation].Instances {
+	for reservation := range reservations {
+		for instance := range reservations[reservation].Instances {
 			// Create a new theInstance variable for each run through the loop
 			theInstance := ec2.CreateImageInput{}
+			theBkup := bkupInstance{preHook: preHook, postHook: postHook}
+			noReboot := !reboot
+
+			// instances with no Name tag are named after the instance id
+			nameData := imageNameData{
+				Name:       *reservations[reservation].Instances[instance].InstanceID,
+				InstanceID: *reservations[reservation].Instances[instance].InstanceID,
+				Date:       now.Format("2006-01-02"),
+				Time:       now.Format("150405"),
+			}
 
-			for tag := range resp.Reservations[reservation].Instances[instance].Tags {
-				if *resp.Reservations[reservation].Instances[instance].Tags[tag].Key == "Name" {
-					// name of the created AMI must be unique so add the Unix Epoch
-					theInstance.Name = aws.String(
-						*resp.Reservations[reservation].Instances[instance].Tags[tag].Value +
-							"-" +
-							strconv.FormatInt(time.Now().Unix(), 10))
-					break
-				} else {
-					theInstance.Name = aws.String(
-						*resp.Reservations[reservation].Instances[instance].InstanceID +
-							"-" +
-							strconv.FormatInt(time.Now().Unix(), 10))
+			// instance tags override the reboot setting and can select a hook defined
+			// on this host. The tag value is never run as a command
+			for _, tag := range reservations[reservation].Instances[instance].Tags {
+				switch *tag.Key {
+				case "Name":
+					if len(*tag.Value) > 0 {
+						nameData.Name = *tag.Value
+					}
+				case "autobkup-reboot":
+					noReboot = *tag.Value != "true"
+				case "autobkup-hook":
+					if hook, found := hooks[*tag.Value]; found {
+						theBkup.preHook = hook.Pre
+						theBkup.postHook = hook.Post
+					} else {
+						theBkup.hookError = fmt.Sprintf("hook %q named by the autobkup-hook tag is not defined", *tag.Value)
+					}
 				}
 			}
-			theInstance.Description = aws.String("Auto backup of instance " + *resp.Reservations[reservation].Instances[instance].InstanceID)
-			theInstance.InstanceID = resp.Reservations[reservation].Instances[instance].InstanceID
-			theInstance.NoReboot = aws.Boolean(true)
+
+			imageName, err := buildImageName(svc, nameTmpl, nameData, usedNames)
+			if err != nil {
+				log.Fatalf("Fatal error: unable to build AMI name for instance %s - %s\n", nameData.InstanceID, err)
+			}
+			theInstance.Name = aws.String(imageName)
+			theInstance.Description = aws.String("Auto backup of instance " + *reservations[reservation].Instances[instance].InstanceID)
+			theInstance.InstanceID = reservations[reservation].Instances[instance].InstanceID
+			theInstance.NoReboot = aws.Boolean(noReboot)
+			theBkup.image = theInstance
 			// append details on this instance to the slice
-			bkupInstances = append(bkupInstances, &theInstance)
+			bkupInstances = append(bkupInstances, &theBkup)
+		}
+	}
+	return
+}
+
+// buildImageName executes the name template for an instance, cleans the result so it
+// is a valid AMI name and makes it unique against existing images and this run
+func buildImageName(svc *ec2.EC2, nameTmpl *template.Template, nameData imageNameData, usedNames map[string]bool) (string, error) {
+
+	var buf bytes.Buffer
+	if err := nameTmpl.Execute(&buf, nameData); err != nil {
+		return "", err
+	}
+
+	base := sanitiseImageName(buf.String())
+	if len(base) < 3 {
+		base = sanitiseImageName(nameData.InstanceID + "-" + nameData.Date)
+	}
+
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			suffix := "-" + strconv.Itoa(i)
+			if len(base)+len(suffix) > 128 {
+				name = base[:128-len(suffix)]
+			}
+			name += suffix
+		}
+
+		if usedNames[name] {
+			continue
+		}
+
+		ec2dii := ec2.DescribeImagesInput{
+			Owners:  []*string{aws.String("self")},
+			Filters: []*ec2.Filter{&ec2.Filter{Name: aws.String("name"), Values: []*string{aws.String(name)}}}}
+
+		resp, err := svc.DescribeImages(&ec2dii)
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Images) == 0 {
+			usedNames[name] = true
+			return name, nil
+		}
+	}
+}
+
+// sanitiseImageName replaces any characters not allowed in an AMI name and
+// limits the name to the maximum of 128 characters
+func sanitiseImageName(name string) string {
+
+	clean := []byte{}
+	for _, r := range strings.TrimSpace(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			clean = append(clean, byte(r))
+		case strings.ContainsRune("()[] ./-'@_", r):
+			clean = append(clean, byte(r))
+		default:
+			clean = append(clean, '-')
+		}
+	}
+
+	if len(clean) > 128 {
+		clean = clean[:128]
+	}
+	return string(clean)
+}
+
+// getBkupVolumes returns the EBS volumes to be snapshotted. These are the volumes attached
+// to the instances being backed up, limited to devices if provided, and in auto mode
+// any volume with an autobkup tag
+func getBkupVolumes(svc *ec2.EC2, bkupId string, devices []string) (bkupVolumes []*bkupVolume) {
+
+	// volumes can be both attached to a tagged instance and tagged themselves
+	seen := make(map[string]bool)
+
+	for _, reservation := range describeBkupInstances(svc, bkupId) {
+		for _, instance := range reservation.Instances {
+			for _, bdm := range instance.BlockDeviceMappings {
+				// only EBS volumes can be snapshotted
+				if bdm.EBS == nil || bdm.EBS.VolumeID == nil {
+					continue
+				}
+				if len(devices) > 0 && !containsString(devices, *bdm.DeviceName) {
+					continue
+				}
+				seen[*bdm.EBS.VolumeID] = true
+				bkupVolumes = append(bkupVolumes, &bkupVolume{
+					snapshot: ec2.CreateSnapshotInput{
+						VolumeID:    bdm.EBS.VolumeID,
+						Description: aws.String("Auto backup of volume " + *bdm.DeviceName + " on instance " + *instance.InstanceID),
+					},
+					instanceID: *instance.InstanceID,
+					device:     *bdm.DeviceName,
+				})
+			}
+		}
+	}
+
+	// a single instance was asked for so do not go looking for tagged volumes
+	if len(bkupId) > 0 {
+		return
+	}
+
+	ec2dvi := ec2.DescribeVolumesInput{Filters: []*ec2.Filter{&ec2.Filter{
+		Name:   aws.String("tag-key"),
+		Values: []*string{aws.String("autobkup")}}}}
+
+	resp, err := svc.DescribeVolumes(&ec2dvi)
+	if awserr := aws.Error(err); awserr != nil {
+		// A service error occurred.
+		log.Fatalf("AWS Error: %s - %s", awserr.Code, awserr.Message)
+	} else if err != nil {
+		// A non-service error occurred.
+		log.Fatalf("Fatal error: DescribeVolumes - %s\n", err)
+	}
+
+	for _, volume := range resp.Volumes {
+		if seen[*volume.VolumeID] {
+			continue
+		}
+		theVolume := bkupVolume{snapshot: ec2.CreateSnapshotInput{
+			VolumeID:    volume.VolumeID,
+			Description: aws.String("Auto backup of volume " + *volume.VolumeID),
+		}}
+		if len(volume.Attachments) > 0 {
+			theVolume.instanceID = *volume.Attachments[0].InstanceID
+			theVolume.device = *volume.Attachments[0].Device
+		}
+		bkupVolumes = append(bkupVolumes, &theVolume)
+	}
+	return
+}
+
+// containsString returns true if s is in the slice
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ssVolume snapshots an EBS volume and tags the snapshot for auto cleanup
+func ssVolume(svc *ec2.EC2, theVolume *bkupVolume, verify bool) (result *bkupResult) {
+
+	started := time.Now()
+
+	snapName := "Autobkup-" + *theVolume.snapshot.VolumeID
+	if len(theVolume.instanceID) > 0 {
+		snapName = "Autobkup-" + theVolume.instanceID + "-" + theVolume.device
+	}
+
+	result = &bkupResult{InstanceID: theVolume.instanceID, VolumeID: *theVolume.snapshot.VolumeID, Name: snapName}
+	defer func() { result.Seconds = time.Since(started).Seconds() }()
+
+	snapshotResp, err := svc.CreateSnapshot(&theVolume.snapshot)
+	if awserr := aws.Error(err); awserr != nil {
+		// A service error occurred.
+		log.Printf("AWS Error: %s - %s", awserr.Code, awserr.Message)
+		result.Error = fmt.Sprintf("CreateSnapshot: %s - %s", awserr.Code, awserr.Message)
+		return
+	} else if err != nil {
+		// A non-service error occurred.
+		log.Printf("Fatal error: CreateSnapshot - %s\n", err)
+		result.Error = fmt.Sprintf("CreateSnapshot: %s", err)
+		return
+	}
+	result.SnapshotIDs = []string{*snapshotResp.SnapshotID}
+
+	// store the creation time in the tag so it can be checked during auto cleanup
+	ec2cti := ec2.CreateTagsInput{
+		Resources: []*string{snapshotResp.SnapshotID},
+		Tags: []*ec2.Tag{
+			&ec2.Tag{
+				Key:   aws.String("autocleanup"),
+				Value: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+			&ec2.Tag{
+				Key:   aws.String("Name"),
+				Value: aws.String(snapName)}}}
+
+	if _, err = svc.CreateTags(&ec2cti); err != nil {
+		log.Printf("non-fatal error adding autocleanup tag to snapshot: %v\n", err)
+		result.TagError = fmt.Sprintf("CreateTags: %v", err)
+	}
+
+	if verbose {
+		fmt.Printf("Snapshot of volume %s named %s started. New snapshot: %s\n", *theVolume.snapshot.VolumeID, snapName, *snapshotResp.SnapshotID)
+	}
+
+	if verify {
+		if err = waitForSnapshots(svc, []*string{snapshotResp.SnapshotID}); err != nil {
+			result.VerifyError = err.Error()
+			return
 		}
+		result.Verified = true
 	}
 	return
 }
 
-func ssInstance(svc *ec2.EC2, abkupInstance *ec2.CreateImageInput) {
+func ssInstance(svc *ec2.EC2, theBkup *bkupInstance, verify bool) (result *bkupResult) {
+
+	started := time.Now()
+
+	abkupInstance := &theBkup.image
+
+	result = &bkupResult{InstanceID: *abkupInstance.InstanceID, Name: *abkupInstance.Name}
+	defer func() { result.Seconds = time.Since(started).Seconds() }()
+
+	if len(theBkup.hookError) > 0 {
+		log.Printf("Not creating image of instance %s: %s\n", *abkupInstance.InstanceID, theBkup.hookError)
+		result.Error = theBkup.hookError
+		return
+	}
+
+	// freeze the application before the image is created
+	if len(theBkup.preHook) > 0 {
+		if err := runner.Run(*abkupInstance.InstanceID, theBkup.preHook); err != nil {
+			log.Printf("Pre image command failed for instance %s. Not creating image: %v\n", *abkupInstance.InstanceID, err)
+			result.Error = fmt.Sprintf("pre image command: %v", err)
+			// the pre command may have partly run so always try the post command
+			runPostHook(theBkup)
+			return
+		}
+	}
 
 	createImageResp, err := svc.CreateImage(abkupInstance)
+
+	// the snapshots are taken from the point CreateImage returns so the application can be unfrozen
+	runPostHook(theBkup)
+
 	if awserr := aws.Error(err); awserr != nil {
 		// A service error occurred.
 		log.Printf("AWS Error: %s - %s", awserr.Code, awserr.Message)
+		result.Error = fmt.Sprintf("CreateImage: %s - %s", awserr.Code, awserr.Message)
 		return
 	} else if err != nil {
 		// A non-service error occurred.
 		log.Printf("Fatal error: DescribeInstances - %s\n", err)
+		result.Error = fmt.Sprintf("CreateImage: %s", err)
 		return
 	}
+	result.ImageID = *createImageResp.ImageID
 
 	// Having some issues with AMI not valid when we try and tag it so give it some time to become ready
 	time.Sleep(47 * time.Second)
@@ -117,12 +614,16 @@ func ssInstance(svc *ec2.EC2, abkupInstance *ec2.CreateImageInput) {
 				Value: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
 			&ec2.Tag{
 				Key:   aws.String("Name"),
-				Value: aws.String("Autobkup-" + *abkupInstance.InstanceID)}}}
+				Value: abkupInstance.Name},
+			&ec2.Tag{
+				Key:   aws.String("autobkup-instance"),
+				Value: abkupInstance.InstanceID}}}
 
 	_, err = svc.CreateTags(&ec2cti)
 
 	if err != nil {
 		log.Printf("non-fatal error adding autocleanup tag to image: %v\n", err)
+		result.TagError = fmt.Sprintf("CreateTags: %v", err)
 	}
 
 	if verbose {
@@ -130,17 +631,251 @@ func ssInstance(svc *ec2.EC2, abkupInstance *ec2.CreateImageInput) {
 		fmt.Printf("Backing up instance Id: %s named %s completed. New AMI: %s\n", *abkupInstance.InstanceID, *abkupInstance.Name, *createImageResp.ImageID)
 	}
 
+	if len(shareAccount) > 0 {
+		if err = backupImage(svc, createImageResp.ImageID); err != nil {
+			result.BackupError = err.Error()
+		}
+	}
+
+	if verify {
+		if err = verifyImage(svc, createImageResp.ImageID, result); err != nil {
+			result.VerifyError = err.Error()
+			return
+		}
+		result.Verified = true
+	}
+	return
+}
+
+// verifyImage waits for the image to be available and all of its snapshots to complete
+func verifyImage(svc *ec2.EC2, imageID *string, result *bkupResult) error {
+
+	image, err := waitForImage(svc, imageID)
+	if err != nil {
+		return err
+	}
+
+	snapshotIDs := []*string{}
+	for _, bdm := range image.BlockDeviceMappings {
+		if bdm.EBS == nil || bdm.EBS.SnapshotID == nil {
+			continue
+		}
+		snapshotIDs = append(snapshotIDs, bdm.EBS.SnapshotID)
+		result.SnapshotIDs = append(result.SnapshotIDs, *bdm.EBS.SnapshotID)
+	}
+
+	return waitForSnapshots(svc, snapshotIDs)
+}
+
+// waitForSnapshots polls AWS until all of the snapshots are completed
+func waitForSnapshots(svc *ec2.EC2, snapshotIDs []*string) error {
+
+	if len(snapshotIDs) == 0 {
+		return nil
+	}
+
+	ec2dsi := ec2.DescribeSnapshotsInput{SnapshotIDs: snapshotIDs}
+
+	for deadline := time.Now().Add(backupWait); time.Now().Before(deadline); {
+		resp, err := svc.DescribeSnapshots(&ec2dsi)
+		if err != nil {
+			return err
+		}
+
+		completed := 0
+		for _, snapshot := range resp.Snapshots {
+			switch *snapshot.State {
+			case "completed":
+				completed++
+			case "error":
+				return fmt.Errorf("snapshot %s is in state error", *snapshot.SnapshotID)
+			}
+		}
+		if completed == len(snapshotIDs) {
+			return nil
+		}
+		time.Sleep(30 * time.Second)
+	}
+	return fmt.Errorf("timed out waiting for snapshots to complete")
+}
+
+// runPostHook runs the post image command for the instance if one is set
+func runPostHook(theBkup *bkupInstance) {
+	if len(theBkup.postHook) == 0 {
+		return
+	}
+	if err := runner.Run(*theBkup.image.InstanceID, theBkup.postHook); err != nil {
+		log.Printf("non-fatal error running post image command for instance %s: %v\n", *theBkup.image.InstanceID, err)
+	}
+}
+
+// backupImage shares the image with the backup account and if a backup role was
+// provided copies the image into the backup account
+func backupImage(svc *ec2.EC2, imageID *string) error {
+
+	// snapshot ids are only known once the image is available
+	image, err := waitForImage(svc, imageID)
+	if err != nil {
+		log.Printf("non-fatal error waiting for image %s to become available: %v\n", *imageID, err)
+		return err
+	}
+
+	if err = shareImage(svc, image, shareAccount); err != nil {
+		log.Printf("non-fatal error sharing image %s with account %s: %v\n", *imageID, shareAccount, err)
+		return fmt.Errorf("sharing with account %s: %v", shareAccount, err)
+	}
+
+	if verbose {
+		fmt.Printf("Image %s and snapshots shared with account %s\n", *imageID, shareAccount)
+	}
+
+	if len(backupRole) == 0 {
+		return nil
+	}
+
+	// the role is assumed for each copy as waiting for a large image can take longer
+	// than the credentials last
+	backupSvc, err := backupAccountSvc(backupRole, svc.Config.Region)
+	if err != nil {
+		log.Printf("non-fatal error assuming role %s to copy image %s: %v\n", backupRole, *imageID, err)
+		return fmt.Errorf("assuming role %s: %v", backupRole, err)
+	}
+
+	copyImageResp, err := backupSvc.CopyImage(&ec2.CopyImageInput{
+		SourceImageID: image.ImageID,
+		SourceRegion:  aws.String(svc.Config.Region),
+		Name:          image.Name,
+		Description:   image.Description,
+	})
+	if err != nil {
+		log.Printf("non-fatal error copying image %s to account %s: %v\n", *imageID, shareAccount, err)
+		return fmt.Errorf("copying to account %s: %v", shareAccount, err)
+	}
+
+	// copy the tags so the backup account can run awsgo-ami-cleanup with the same rules
+	if err = tagImage(backupSvc, copyImageResp.ImageID, image.Tags); err != nil {
+		log.Printf("non-fatal error adding autocleanup tag to copied image %s: %v\n", *copyImageResp.ImageID, err)
+	}
+
+	if verbose {
+		fmt.Printf("Image %s copied to account %s as %s\n", *imageID, shareAccount, *copyImageResp.ImageID)
+	}
+	return nil
+}
+
+// waitForImage polls AWS until the image is available and returns the image details
+func waitForImage(svc *ec2.EC2, imageID *string) (*ec2.Image, error) {
+
+	ec2dii := ec2.DescribeImagesInput{ImageIDs: []*string{imageID}}
+
+	// the image is only available once its snapshots complete so wait as long as for them
+	for deadline := time.Now().Add(backupWait); time.Now().Before(deadline); {
+		resp, err := svc.DescribeImages(&ec2dii)
+		if awserr := aws.Error(err); awserr != nil && awserr.Code != "InvalidAMIID.NotFound" {
+			return nil, err
+		} else if awserr == nil && err != nil {
+			return nil, err
+		}
+
+		if err == nil && len(resp.Images) > 0 {
+			switch *resp.Images[0].State {
+			case "available":
+				return resp.Images[0], nil
+			case "invalid", "deregistered", "failed", "error":
+				return nil, fmt.Errorf("image %s is in state %s", *imageID, *resp.Images[0].State)
+			}
+		}
+		time.Sleep(20 * time.Second)
+	}
+	return nil, fmt.Errorf("timed out waiting for image %s to become available", *imageID)
+}
+
+// shareImage grants launch permission on the image and create volume permission
+// on each of its snapshots to the account
+func shareImage(svc *ec2.EC2, image *ec2.Image, account string) error {
+
+	ec2miai := ec2.ModifyImageAttributeInput{
+		ImageID: image.ImageID,
+		LaunchPermission: &ec2.LaunchPermissionModifications{
+			Add: []*ec2.LaunchPermission{&ec2.LaunchPermission{UserID: aws.String(account)}}}}
+
+	if _, err := svc.ModifyImageAttribute(&ec2miai); err != nil {
+		return err
+	}
+
+	for _, bdm := range image.BlockDeviceMappings {
+		// instance store volumes have no snapshot to share
+		if bdm.EBS == nil || bdm.EBS.SnapshotID == nil {
+			continue
+		}
+		ec2msai := ec2.ModifySnapshotAttributeInput{
+			SnapshotID: bdm.EBS.SnapshotID,
+			CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
+				Add: []*ec2.CreateVolumePermission{&ec2.CreateVolumePermission{UserID: aws.String(account)}}}}
+
+		if _, err := svc.ModifySnapshotAttribute(&ec2msai); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagImage adds tags to an image retrying while AWS catches up with the new image
+func tagImage(svc *ec2.EC2, imageID *string, tags []*ec2.Tag) (err error) {
+
+	ec2cti := ec2.CreateTagsInput{Resources: []*string{imageID}, Tags: tags}
+
+	for i := 0; i < 10; i++ {
+		_, err = svc.CreateTags(&ec2cti)
+		if awserr := aws.Error(err); awserr == nil || awserr.Code != "InvalidAMIID.NotFound" {
+			return
+		}
+		time.Sleep(10 * time.Second)
+	}
+	return
+}
+
+// backupAccountSvc assumes the role in the backup account and returns an EC2 service
+// object in the same region that acts as the backup account
+func backupAccountSvc(roleARN, region string) (*ec2.EC2, error) {
+
+	svcSts := sts.New(&aws.Config{})
+
+	resp, err := svcSts.AssumeRole(&sts.AssumeRoleInput{
+		RoleARN:         aws.String(roleARN),
+		RoleSessionName: aws.String("awsgo-snapshot-instance"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ec2.New(&aws.Config{
+		Credentials: aws.Creds(*resp.Credentials.AccessKeyID, *resp.Credentials.SecretAccessKey, *resp.Credentials.SessionToken),
+		Region:      region,
+	}), nil
 }
 
 func main() {
 
 	// storage for commandline args
-	var autoFlag bool
-	var bkupId string
+	var autoFlag, reboot, volumeMode, verify bool
+	var bkupId, preHook, postHook, deviceList, reportFile, nameFormat string
+	var hooksFile string
 
 	flag.BoolVar(&verbose, "v", false, "Produce verbose output")
 	flag.BoolVar(&autoFlag, "a", false, "In auto mode snapshot any instance with an autobkup tag")
 	flag.StringVar(&bkupId, "i", "", "Instance id to be backed up")
+	flag.StringVar(&nameFormat, "n", "{{.Name}}-{{.InstanceID}}-{{.Date}}", "Template for the AMI name and Name tag")
+	flag.BoolVar(&volumeMode, "e", false, "Snapshot EBS volumes instead of creating an AMI")
+	flag.StringVar(&deviceList, "d", "", "Comma separated list of device names to snapshot in volume mode")
+	flag.BoolVar(&reboot, "b", false, "Allow instances to be rebooted while the AMI is created")
+	flag.StringVar(&preHook, "pre", "", "Command to run before the AMI is created")
+	flag.StringVar(&postHook, "post", "", "Command to run after the AMI has been created")
+	flag.StringVar(&hooksFile, "hooks", "", "File defining the named hooks instances can select with the autobkup-hook tag")
+	flag.StringVar(&shareAccount, "s", "", "Backup account id to share the new AMI and snapshots with")
+	flag.StringVar(&backupRole, "r", "", "Role ARN in the backup account used to copy the shared AMI")
+	flag.StringVar(&reportFile, "o", "", "File to write the JSON run report to")
+	flag.BoolVar(&verify, "verify", false, "Wait for each AMI to be available and its snapshots completed")
 	flag.Parse()
 
 	// make sure we are in auto mode or an ami id has been provided
@@ -150,20 +885,74 @@ func main() {
 		os.Exit(0)
 	}
 
+	nameTmpl, err := template.New("name").Parse(nameFormat)
+	if err != nil {
+		log.Fatalf("Invalid AMI name template %s - %s\n", nameFormat, err)
+	}
+
+	hooks := make(map[string]imageHook)
+	if len(hooksFile) > 0 {
+		if hooks, err = loadHooks(hooksFile); err != nil {
+			log.Fatalf("Unable to load hooks - %s\n", err)
+		}
+	}
+
 	// Create an EC2 service object
 	// config values keys, sercet key & region read from environment
 	svc := ec2.New(&aws.Config{})
 
-	// load the struct that has details on all instances to be snapshotted
-	bkupInstances := getBkupInstances(svc, bkupId)
+	runner = localRunner{}
 
-	// now we have the slice of instances to be backed up we can create the AMI then tag them
+	if len(backupRole) > 0 {
+		if len(shareAccount) == 0 {
+			log.Fatalf("A backup account id (-s) is required when copying to the backup account\n")
+		}
+		// check the role can be assumed before creating anything
+		if _, err = backupAccountSvc(backupRole, svc.Config.Region); err != nil {
+			log.Fatalf("Fatal error: unable to assume role %s - %s\n", backupRole, err)
+		}
+	}
+
+	report := &runReport{Started: time.Now()}
 
 	var wg sync.WaitGroup
 
 	// rate limit the AWS requests to max 3 per second
 	rl := rate.New(3, time.Second)
 
+	if volumeMode {
+		var devices []string
+		if len(deviceList) > 0 {
+			devices = strings.Split(deviceList, ",")
+		}
+
+		bkupVolumes := getBkupVolumes(svc, bkupId, devices)
+		report.Considered = len(bkupVolumes)
+
+		for _, theVolume := range bkupVolumes {
+
+			rl.Wait()
+
+			wg.Add(1)
+
+			go func(svc *ec2.EC2, theVolume bkupVolume) {
+				defer wg.Done()
+				report.add(ssVolume(svc, &theVolume, verify))
+			}(svc, *theVolume)
+		}
+
+		wg.Wait()
+
+		finishRun(report, reportFile)
+		return
+	}
+
+	// load the struct that has details on all instances to be snapshotted
+	bkupInstances := getBkupInstances(svc, bkupId, reboot, preHook, postHook, hooks, nameTmpl)
+	report.Considered = len(bkupInstances)
+
+	// now we have the slice of instances to be backed up we can create the AMI then tag them
+
 	for instance := range bkupInstances {
 
 		rl.Wait()
@@ -172,11 +961,11 @@ func main() {
 		wg.Add(1)
 
 		// Launch a goroutine to fetch the URL.
-		go func(svc *ec2.EC2, abkupInstance ec2.CreateImageInput) {
+		go func(svc *ec2.EC2, theBkup bkupInstance) {
 			// Decrement the counter when the goroutine completes.
 			defer wg.Done()
 			// snapshot the instance.
-			ssInstance(svc, &abkupInstance)
+			report.add(ssInstance(svc, &theBkup, verify))
 		}(svc, *bkupInstances[instance])
 
 	}
@@ -184,9 +973,26 @@ func main() {
 	// Wait for all Amazon requests to complete.
 	wg.Wait()
 
-	if verbose {
-		fmt.Printf("All done.\n")
+	finishRun(report, reportFile)
+}
+
+// finishRun prints and saves the run report and exits non-zero if any backup failed
+func finishRun(report *runReport, reportFile string) {
+
+	report.Finished = time.Now()
+	report.printText()
 
+	if len(reportFile) > 0 {
+		if err := report.writeJSON(reportFile); err != nil {
+			log.Printf("non-fatal error writing run report to %s: %v\n", reportFile, err)
+		}
 	}
 
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+
+	if verbose {
+		fmt.Printf("All done.\n")
+	}
 }